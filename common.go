@@ -27,6 +27,12 @@ type Type struct {
 	size  int // sizeof
 	align int // alignof
 
+	is_volatile bool
+
+	// Integer. Unsigned values are kept zero-extended in registers,
+	// and signed ones sign-extended.
+	is_unsigned bool
+
 	// Pointer
 	ptr_to *Type
 
@@ -34,12 +40,20 @@ type Type struct {
 	ary_of *Type
 	len    int
 
-	// Struct
-	members *Vector
-	offset  int
+	// Struct or union
+	members  *Vector
+	offset   int
+	is_union bool
+
+	// Bitfield
+	bit_width  int
+	bit_offset int
 
-	// Function
-	returning *Type
+	// Function. params is a vector of parameter types, or nil
+	// if the function is declared without a prototype.
+	returning   *Type
+	params      *Vector
+	is_variadic bool
 }
 
 // token.go
@@ -49,18 +63,31 @@ const (
 	TK_STR                    // String literal
 	TK_IDENT                  // Identifier
 	TK_ARROW                  // ->
+	TK_ELLIPSIS               // ...
 	TK_EXTERN                 // "extern"
 	TK_TYPEDEF                // "typedef"
+	TK_VOLATILE               // "volatile"
 	TK_INT                    // "int"
 	TK_CHAR                   // "char"
+	TK_SHORT                  // "short"
+	TK_LONG                   // "long"
+	TK_UNSIGNED               // "unsigned"
+	TK_SIGNED                 // "signed"
 	TK_VOID                   // "void"
 	TK_STRUCT                 // "struct"
+	TK_UNION                  // "union"
+	TK_ENUM                   // "enum"
 	TK_IF                     // "if"
 	TK_ELSE                   // "else"
 	TK_FOR                    // "for"
 	TK_DO                     // "do"
 	TK_WHILE                  // "while"
 	TK_BREAK                  // "break"
+	TK_CONTINUE               // "continue"
+	TK_GOTO                   // "goto"
+	TK_SWITCH                 // "switch"
+	TK_CASE                   // "case"
+	TK_DEFAULT                // "default"
 	TK_EQ                     // ==
 	TK_NE                     // !=
 	TK_LE                     // <=
@@ -84,6 +111,7 @@ const (
 	TK_RETURN                 // "return"
 	TK_SIZEOF                 // "sizeof"
 	TK_ALIGNOF                // "_Alignof"
+	TK_ASSERT                 // "_Static_assert"
 	TK_PARAM                  // Function-like macro parameter
 	TK_EOF                    // End marker
 )
@@ -106,60 +134,77 @@ type Token struct {
 	path  string
 	start string
 	end   string
+	line  int
+	col   int
 }
 
 // parse.go
 const (
-	ND_NUM       = iota + 256 // Number literal
-	ND_STR                    // String literal
-	ND_IDENT                  // Identigier
-	ND_STRUCT                 // Struct
-	ND_DECL                   // declaration
-	ND_VARDEF                 // Variable definition
-	ND_LVAR                   // Local variable reference
-	ND_GVAR                   // Global variable reference
-	ND_IF                     // "if"
-	ND_FOR                    // "for"
-	ND_DO_WHILE               // do ... while
-	ND_BREAK                  // break
-	ND_ADDR                   // address-of operator ("&")
-	ND_DEREF                  // pointer dereference ("*")
-	ND_DOT                    // Struct member access
-	ND_EQ                     // ==
-	ND_NE                     // !=
-	ND_LE                     // <=
-	ND_LOGOR                  // ||
-	ND_LOGAND                 // &&
-	ND_SHL                    // <<
-	ND_SHR                    // >>
-	ND_MOD                    // %
-	ND_NEG                    // -
-	ND_POST_INC               // post ++
-	ND_POST_DEC               // post --
-	ND_MUL_EQ                 // *=
-	ND_DIV_EQ                 // /=
-	ND_MOD_EQ                 // %=
-	ND_ADD_EQ                 // +=
-	ND_SUB_EQ                 // -=
-	ND_SHL_EQ                 // <<=
-	ND_SHR_EQ                 // >>=
-	ND_BITAND_EQ              // &=
-	ND_XOR_EQ                 // ^=
-	ND_BITOR_EQ               // |=
-	ND_RETURN                 // "return"
-	ND_SIZEOF                 // "sizeof"
-	ND_ALIGNOF                // "_Alignof"
-	ND_CALL                   // Function call
-	ND_FUNC                   // Function definition
-	ND_COMP_STMT              // Compound statement
-	ND_EXPR_STMT              // Expressions statement
-	ND_STMT_EXPR              // Statement expression (GUN extn.)
-	ND_NULL                   // Null statement
+	ND_NUM         = iota + 256 // Number literal
+	ND_STR                      // String literal
+	ND_IDENT                    // Identigier
+	ND_STRUCT                   // Struct
+	ND_DECL                     // declaration
+	ND_VARDEF                   // Variable definition
+	ND_LVAR                     // Local variable reference
+	ND_GVAR                     // Global variable reference
+	ND_IF                       // "if"
+	ND_FOR                      // "for"
+	ND_DO_WHILE                 // do ... while
+	ND_BREAK                    // break
+	ND_CONTINUE                 // continue
+	ND_GOTO                     // goto
+	ND_LABEL                    // Labeled statement
+	ND_SWITCH                   // switch
+	ND_CASE                     // case
+	ND_DEFAULT                  // default
+	ND_ADDR                     // address-of operator ("&")
+	ND_DEREF                    // pointer dereference ("*")
+	ND_DOT                      // Struct member access
+	ND_EQ                       // ==
+	ND_NE                       // !=
+	ND_LE                       // <=
+	ND_LOGOR                    // ||
+	ND_LOGAND                   // &&
+	ND_SHL                      // <<
+	ND_SHR                      // >>
+	ND_MOD                      // %
+	ND_NEG                      // -
+	ND_POST_INC                 // post ++
+	ND_POST_DEC                 // post --
+	ND_MUL_EQ                   // *=
+	ND_DIV_EQ                   // /=
+	ND_MOD_EQ                   // %=
+	ND_ADD_EQ                   // +=
+	ND_SUB_EQ                   // -=
+	ND_SHL_EQ                   // <<=
+	ND_SHR_EQ                   // >>=
+	ND_BITAND_EQ                // &=
+	ND_XOR_EQ                   // ^=
+	ND_BITOR_EQ                 // |=
+	ND_RETURN                   // "return"
+	ND_SIZEOF                   // "sizeof"
+	ND_ALIGNOF                  // "_Alignof"
+	ND_CALL                     // Function call
+	ND_CAST                     // Type conversion
+	ND_VA_START                 // __builtin_va_start()
+	ND_VA_ARG                   // __builtin_va_arg()
+	ND_TRAP                     // __builtin_trap()
+	ND_UNREACHABLE              // __builtin_unreachable()
+	ND_STRUCT_EQ                // __builtin_struct_eq()
+	ND_FUNC                     // Function definition
+	ND_COMP_STMT                // Compound statement
+	ND_DECL_LIST                // Declarations in one statement, e.g. `int a, b;`
+	ND_EXPR_STMT                // Expressions statement
+	ND_STMT_EXPR                // Statement expression (GUN extn.)
+	ND_NULL                     // Null statement
 )
 
 const (
 	INT = iota
 	CHAR
+	SHORT
+	LONG
 	VOID
 	PTR
 	ARY
@@ -178,6 +223,9 @@ type Node struct {
 
 	name string // Identifier
 
+	// The token a diagnostic about this node points at
+	token *Token
+
 	// Global variable
 	is_extern bool
 	data      string
@@ -192,17 +240,44 @@ type Node struct {
 	body *Node
 	inc  *Node
 
+	// Aggregate initializer of a local variable, lowered to
+	// assignments to its scalar elements.
+	inits *Vector
+
+	// "switch" ( cond ) body
+	cases        *Vector
+	default_case *Node
+
+	// "case" val: body
+	label int
+
 	// Function definition
 	stacksize int
 	globals   *Vector
 
+	// Variadic function, a call to a function that may be one, or
+	// __builtin_va_arg in a variadic function. va_offset is the offset
+	// of the register save area from BP.
+	is_variadic bool
+	va_offset   int
+
 	// Offset from BP or beginning of a struct
 	offset int
 
+	// Division known to leave no remainder, such as the one
+	// that turns a pointer difference into an element count
+	is_exact bool
+
 	// Function call
 	args *Vector
 }
 
+// GCC-style __attribute__((...))
+type Attr struct {
+	packed  bool
+	aligned int
+}
+
 // sema.go
 
 type Var struct {
@@ -217,6 +292,9 @@ type Var struct {
 	is_extern bool
 	data      string
 	len       int
+	reloc     string // Initialized with the address of this symbol
+	has_val   bool   // Initialized with val, an integer constant
+	val       int
 }
 
 // ir_dump.go
@@ -249,16 +327,24 @@ const (
 	IR_XOR
 	IR_SHL
 	IR_SHR
+	IR_SAR
 	IR_MOD
 	IR_NEG
+	IR_NOT
 	IR_JMP
 	IR_IF
 	IR_UNLESS
+	IR_BR
 	IR_LOAD
 	IR_STORE
 	IR_STORE_ARG
+	IR_LOAD_SPILL
+	IR_STORE_SPILL
 	IR_KILL
 	IR_NOP
+	IR_TRAP
+	IR_UNREACHABLE
+	IR_STRUCT_EQ
 )
 
 type IR struct {
@@ -269,13 +355,45 @@ type IR struct {
 	// Load/Store size in bytes
 	size int
 
+	// Load/Store of a volatile object. It must not be removed
+	// or reordered.
+	is_volatile bool
+
 	// For binary operator. If true, rhs is an immediate.
 	is_imm bool
 
+	// For IR_DIV. If true, lhs is a multiple of rhs.
+	is_exact bool
+
+	// For IR_LOAD, division and comparison. If true, the operands
+	// are unsigned.
+	is_unsigned bool
+
+	// For label. If true, the label is the top of a loop.
+	is_loop bool
+
+	// For IR_BR. Jumps to label if `lhs cond rhs` holds, or if it
+	// does not hold when is_neg is true. cond is IR_EQ, IR_NE,
+	// IR_LT or IR_LE.
+	cond   int
+	is_neg bool
+	label  int
+
 	// Function call
 	name  string
 	nargs int
-	args  [6]int
+	args  []int
+
+	// For IR_CALL. Offsets of the arguments passed on the stack.
+	stack_args []int
+
+	// For IR_CALL. Caller-saved physical registers that are live
+	// across the call. Set by the register allocator.
+	live_regs []int
+
+	// For IR_CALL. The callee may be variadic, so al must be set
+	// to the number of vector registers used, which is always 0.
+	is_variadic bool
 }
 
 const (
@@ -291,12 +409,18 @@ const (
 	IR_TY_REG_IMM
 	IR_TY_STORE_ARG
 	IR_TY_REG_LABEL
+	IR_TY_BR
 	IR_TY_CALL
 )
 
 type Function struct {
 	name      string
+	token     *Token
 	stacksize int
 	globals   *Vector
 	ir        *Vector
+
+	// Bytes of stack used by a call, including the return address
+	// and saved registers. Set by gen_x86.
+	stack_usage int
 }
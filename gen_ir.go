@@ -6,18 +6,24 @@ package main
 // IR resembles the real x86-64 instruction set, but it has infinite
 // number of registers. We don't try too hard to reuse registers in
 // this pass. Instead, we "kill" registers to mark them as dead when
-// we are done with them and use new registers.
+// we are done with them and use new registers. The register allocator
+// computes liveness by itself, so kills are only hints for the
+// optimizer, which forgets the values held in killed registers.
 //
 // Such infinite number of registers are mapped to a finite registers
 // in a later pass.
 
 var (
-	code         *Vector
-	nreg         = 1
-	nlabel       = 1
-	return_label int
-	return_reg   int
-	break_label  int
+	code           *Vector
+	nreg           = 1
+	nlabel         = 1
+	return_label   int
+	return_reg     int
+	break_label    int
+	continue_label int
+
+	// Labels defined by the user in the current function
+	user_labels *Map
 )
 
 func add(op, lhs, rhs int) *IR {
@@ -43,6 +49,24 @@ func label(x int) {
 	add(IR_LABEL, x, -1)
 }
 
+// Returns the label number of a user-defined label. Because all
+// local variables are allocated in a single stack frame, jumping
+// out of or into a block needs no stack adjustment.
+func user_label(name string) int {
+	x := map_geti(user_labels, name, 0)
+	if x == 0 {
+		x = nlabel
+		nlabel++
+		map_puti(user_labels, name, x)
+	}
+	return x
+}
+
+func loop_label(x int) {
+	ir := add(IR_LABEL, x, -1)
+	ir.is_loop = true
+}
+
 func jmp(x int) {
 	add(IR_JMP, x, -1)
 }
@@ -50,11 +74,115 @@ func jmp(x int) {
 func load(node *Node, dst, src int) {
 	ir := add(IR_LOAD, dst, src)
 	ir.size = node.ty.size
+	ir.is_volatile = node.ty.is_volatile
+	ir.is_unsigned = node.ty.is_unsigned
+	if node.ty.bit_width > 0 {
+		extract_bitfield(node.ty, dst)
+	}
+}
+
+// Returns the right shift that extends the sign of ty, or
+// zero-extends it if ty is unsigned.
+func shr_op(ty *Type) int {
+	if ty.is_unsigned {
+		return IR_SHR
+	}
+	return IR_SAR
+}
+
+// Sign- or zero-extends the bitfield in the lowest bits of r.
+func sext_bitfield(ty *Type, r int) {
+	add_imm(IR_SHL, r, 64-ty.bit_width)
+	add_imm(shr_op(ty), r, 64-ty.bit_width)
+}
+
+// Moves a bitfield in a loaded storage unit to the lowest bits.
+func extract_bitfield(ty *Type, r int) {
+	add_imm(IR_SHL, r, 64-ty.bit_width-ty.bit_offset)
+	add_imm(shr_op(ty), r, 64-ty.bit_width)
+}
+
+// Truncates r to the size of ty and extends it back to a full
+// register, with its sign or with zeros if ty is unsigned.
+func normalize(ty *Type, r int) {
+	add_imm(IR_SHL, r, 64-ty.size*8)
+	add_imm(shr_op(ty), r, 64-ty.size*8)
+}
+
+// Converts r from type from to type to. Registers hold values
+// extended to 64 bits, so only narrowing, converting a signed value
+// to a narrow unsigned type and the reverse at the same width change
+// the bits.
+func conv(from, to *Type, r int) {
+	if !is_integer(to) || to.size == 8 {
+		return
+	}
+	if to.size < from.size ||
+		(to.is_unsigned && !from.is_unsigned) ||
+		(to.size == from.size && from.is_unsigned && !to.is_unsigned) {
+		normalize(to, r)
+	}
+}
+
+// Wraps r around after arithmetic that may have carried it out of
+// the range of ty. A signed int overflow is undefined, so int
+// results are left as they are.
+func wrap(ty *Type, r int) {
+	if is_integer(ty) && ty.size < 8 && (ty.size < 4 || ty.is_unsigned) {
+		normalize(ty, r)
+	}
+}
+
+// Evaluates an operand converted to ty.
+func gen_operand(node *Node, ty *Type) int {
+	r := gen_expr(node)
+	conv(node.ty, ty, r)
+	return r
 }
 
 func store(node *Node, dst, src int) {
+	if node.ty.bit_width > 0 {
+		store_bitfield(node.ty, dst, src)
+		return
+	}
 	ir := add(IR_STORE, dst, src)
 	ir.size = node.ty.size
+	ir.is_volatile = node.ty.is_volatile
+}
+
+// Writes the lowest bits of src to a bitfield, leaving the other bits
+// of the storage unit intact. src is truncated to the bitfield width
+// because it is the value of the assignment expression.
+func store_bitfield(ty *Type, dst, src int) {
+	mask := 1<<uint(ty.bit_width) - 1
+
+	old := nreg
+	nreg++
+	ir := add(IR_LOAD, old, dst)
+	ir.size = ty.size
+	ir.is_volatile = ty.is_volatile
+
+	m := nreg
+	nreg++
+	add(IR_IMM, m, ^(mask << uint(ty.bit_offset)))
+	add(IR_AND, old, m)
+
+	val := nreg
+	nreg++
+	add(IR_MOV, val, src)
+	add(IR_IMM, m, mask)
+	add(IR_AND, val, m)
+	kill(m)
+	add_imm(IR_SHL, val, ty.bit_offset)
+	add(IR_OR, old, val)
+	kill(val)
+
+	ir = add(IR_STORE, dst, old)
+	ir.size = ty.size
+	ir.is_volatile = ty.is_volatile
+	kill(old)
+
+	sext_bitfield(ty, src)
 }
 
 func store_arg(node *Node, bpoff, argreg int) {
@@ -105,9 +233,45 @@ func gen_lval(node *Node) int {
 }
 
 func gen_binop(ty int, node *Node) int {
-	lhs, rhs := gen_expr(node.lhs), gen_expr(node.rhs)
+	lhs, rhs := gen_operand(node.lhs, node.ty), gen_operand(node.rhs, node.ty)
 	add(ty, lhs, rhs)
 	kill(rhs)
+	wrap(node.ty, lhs)
+	return lhs
+}
+
+// Division needs to know the operand width to sign-extend the
+// dividend correctly, and whether it is unsigned.
+func gen_divop(ty int, node *Node) int {
+	lhs, rhs := gen_operand(node.lhs, node.ty), gen_operand(node.rhs, node.ty)
+	ir := add(ty, lhs, rhs)
+	ir.size = node.ty.size
+	ir.is_unsigned = node.ty.is_unsigned
+	ir.is_exact = node.is_exact
+	kill(rhs)
+	return lhs
+}
+
+// Operands are compared in their common type. Pointers are compared
+// as unsigned addresses.
+func gen_cmp(ty int, node *Node) int {
+	cty := arith_ty(node.lhs.ty, node.rhs.ty)
+	lhs, rhs := gen_operand(node.lhs, cty), gen_operand(node.rhs, cty)
+	ir := add(ty, lhs, rhs)
+	ir.is_unsigned = cty.is_unsigned || node.lhs.ty.ty == PTR || node.rhs.ty.ty == PTR
+	kill(rhs)
+	return lhs
+}
+
+// A constant shift count is encoded as an immediate so that
+// it doesn't have to go through cl.
+func gen_shift(ty int, node *Node) int {
+	if node.rhs.op != ND_NUM {
+		return gen_binop(ty, node)
+	}
+	lhs := gen_operand(node.lhs, node.ty)
+	add_imm(ty, lhs, node.rhs.val)
+	wrap(node.ty, lhs)
 	return lhs
 }
 
@@ -126,12 +290,14 @@ func gen_pre_inc(node *Node, num int) int {
 	add_imm(IR_ADD, val, num*get_inc_scale(node))
 	store(node, addr, val)
 	kill(addr)
+	wrap(node.ty, val)
 	return val
 }
 
 func gen_post_inc(node *Node, num int) int {
 	val := gen_pre_inc(node, num)
 	add_imm(IR_SUB, val, num*get_inc_scale(node))
+	wrap(node.ty, val)
 	return val
 }
 
@@ -150,7 +316,7 @@ func to_assign_op(op int) int {
 	case ND_SHL_EQ:
 		return IR_SHL
 	case ND_SHR_EQ:
-		return IR_SHR
+		return IR_SAR
 	case ND_BITAND_EQ:
 		return IR_AND
 	case ND_XOR_EQ:
@@ -161,17 +327,32 @@ func to_assign_op(op int) int {
 	}
 }
 
+// The operation is done in the common type of both sides, and
+// the result is converted back to the type of the left side.
 func gen_assign_op(node *Node) int {
-	src := gen_expr(node.rhs)
+	ty := arith_ty(node.lhs.ty, node.rhs.ty)
+	if node.op == ND_SHL_EQ || node.op == ND_SHR_EQ || node.lhs.ty.ty == PTR {
+		ty = node.lhs.ty
+	}
+
+	src := gen_operand(node.rhs, ty)
 	dst := gen_lval(node.lhs)
 	val := nreg
 	nreg++
 
 	load(node, val, dst)
-	add(to_assign_op(node.op), val, src)
+	conv(node.ty, ty, val)
+	op := to_assign_op(node.op)
+	if op == IR_SAR {
+		op = shr_op(ty)
+	}
+	ir := add(op, val, src)
+	ir.size = ty.size
+	ir.is_unsigned = ty.is_unsigned
 	kill(src)
 	store(node, dst, val)
 	kill(dst)
+	wrap(node.ty, val)
 	return val
 }
 
@@ -186,9 +367,9 @@ func gen_expr(node *Node) int {
 			return r
 		}
 	case ND_EQ:
-		return gen_binop(IR_EQ, node)
+		return gen_cmp(IR_EQ, node)
 	case ND_NE:
-		return gen_binop(IR_NE, node)
+		return gen_cmp(IR_NE, node)
 	case ND_LOGAND:
 		{
 			x := nlabel
@@ -225,38 +406,126 @@ func gen_expr(node *Node) int {
 	case ND_GVAR, ND_LVAR, ND_DOT:
 		{
 			r := gen_lval(node)
-			load(node, r, r)
+			if node.ty.ty != STRUCT {
+				load(node, r, r)
+			}
 			return r
 		}
 
 	case ND_CALL:
 		{
-			var args [6]int
+			var args, stack_args []int
 			for i := 0; i < node.args.len; i++ {
-				args[i] = gen_expr(node.args.data[i].(*Node))
+				r := gen_expr(node.args.data[i].(*Node))
+				if i < len(argregs) {
+					args = append(args, r)
+					continue
+				}
+
+				off := node.offset - (i-len(argregs))*8
+				addr := nreg
+				nreg++
+				add(IR_BPREL, addr, off)
+				ir := add(IR_STORE, addr, r)
+				ir.size = 8
+				kill(addr)
+				kill(r)
+				stack_args = append(stack_args, off)
 			}
 			r := nreg
 			nreg++
 
 			ir := add(IR_CALL, r, -1)
 			ir.name = node.name
-			ir.nargs = node.args.len
-			for i := 0; i < 6; i++ {
-				ir.args[i] = args[i]
-			}
+			ir.nargs = len(args)
+			ir.args = args
+			ir.stack_args = stack_args
+			ir.is_variadic = node.is_variadic
 			for i := 0; i < ir.nargs; i++ {
 				kill(ir.args[i])
 			}
 			return r
 		}
+	case ND_VA_START:
+		{
+			addr := gen_lval(node.expr)
+			r := nreg
+			nreg++
+			add(IR_BPREL, r, node.offset)
+			ir := add(IR_STORE, addr, r)
+			ir.size = 8
+			kill(addr)
+			return r
+		}
+	case ND_VA_ARG:
+		{
+			// Reads a value at the va_list and advances it to the next slot.
+			addr := gen_lval(node.expr)
+			p := nreg
+			nreg++
+			ir := add(IR_LOAD, p, addr)
+			ir.size = 8
+
+			r := nreg
+			nreg++
+			load(node, r, p)
+
+			add_imm(IR_ADD, p, 8)
+
+			// Past the register save area, unnamed arguments continue
+			// on the stack above the return address.
+			if node.is_variadic {
+				end := nreg
+				nreg++
+				add(IR_BPREL, end, node.va_offset-len(argregs)*8)
+				add(IR_EQ, end, p)
+				x := nlabel
+				nlabel++
+				add(IR_UNLESS, end, x)
+				add(IR_BPREL, p, -16)
+				label(x)
+				kill(end)
+			}
+
+			ir = add(IR_STORE, addr, p)
+			ir.size = 8
+			kill(p)
+			kill(addr)
+			return r
+		}
+	case ND_TRAP, ND_UNREACHABLE:
+		{
+			if node.op == ND_TRAP {
+				add(IR_TRAP, -1, -1)
+			} else {
+				add(IR_UNREACHABLE, -1, -1)
+			}
+			r := nreg
+			nreg++
+			return r
+		}
+	case ND_STRUCT_EQ:
+		{
+			// Struct-typed expressions evaluate to their addresses.
+			lhs := gen_expr(node.lhs)
+			rhs := gen_expr(node.rhs)
+			ir := add(IR_STRUCT_EQ, lhs, rhs)
+			ir.size = node.lhs.ty.size
+			kill(rhs)
+			return lhs
+		}
 	case ND_ADDR:
 		{
 			return gen_lval(node.expr)
 		}
 	case ND_DEREF:
 		{
+			// A struct cannot be held in a register, so a dereferenced
+			// struct is represented by its address.
 			r := gen_expr(node.expr)
-			load(node, r, r)
+			if node.ty.ty != STRUCT {
+				load(node, r, r)
+			}
 			return r
 		}
 	case ND_STMT_EXPR:
@@ -269,7 +538,20 @@ func gen_expr(node *Node) int {
 			nreg++
 			return_reg = r
 
-			gen_stmt(node.body)
+			// The value of the last expression statement is the value
+			// of the statement expression. break_label is left intact,
+			// so `break` inside jumps out of the enclosing loop.
+			stmts := node.body.stmts
+			for i := 0; i < stmts.len; i++ {
+				stmt := stmts.data[i].(*Node)
+				if i == stmts.len-1 && stmt.op == ND_EXPR_STMT {
+					r2 := gen_expr(stmt.expr)
+					add(IR_MOV, r, r2)
+					kill(r2)
+					break
+				}
+				gen_stmt(stmt)
+			}
 			label(return_label)
 
 			return_label = orig_label
@@ -292,13 +574,13 @@ func gen_expr(node *Node) int {
 	case '*':
 		return gen_binop(IR_MUL, node)
 	case '/':
-		return gen_binop(IR_DIV, node)
+		return gen_divop(IR_DIV, node)
 	case '%':
-		return gen_binop(IR_MOD, node)
+		return gen_divop(IR_MOD, node)
 	case '<':
-		return gen_binop(IR_LT, node)
+		return gen_cmp(IR_LT, node)
 	case ND_LE:
-		return gen_binop(IR_LE, node)
+		return gen_cmp(IR_LE, node)
 	case '&':
 		return gen_binop(IR_AND, node)
 	case '|':
@@ -306,19 +588,37 @@ func gen_expr(node *Node) int {
 	case '^':
 		return gen_binop(IR_XOR, node)
 	case ND_SHL:
-		return gen_binop(IR_SHL, node)
+		return gen_shift(IR_SHL, node)
 	case ND_SHR:
-		return gen_binop(IR_SHR, node)
+		// >> is an arithmetic shift unless the left side is unsigned.
+		return gen_shift(shr_op(node.ty), node)
 	case '~':
 		{
+			r := gen_operand(node.expr, node.ty)
+			add(IR_NOT, r, -1)
+			wrap(node.ty, r)
+			return r
+		}
+	case ND_CAST:
+		{
+			// A cast to void just discards the value. A widening
+			// cast extends the value from its own width first, since
+			// an overflowed int may have carried into the upper bits.
 			r := gen_expr(node.expr)
-			add_imm(IR_XOR, r, -1)
+			if node.ty.ty == VOID {
+				return r
+			}
+			if is_integer(node.expr.ty) && node.expr.ty.size < node.ty.size {
+				normalize(node.expr.ty, r)
+			}
+			conv(node.expr.ty, node.ty, r)
 			return r
 		}
 	case ND_NEG:
 		{
-			r := gen_expr(node.expr)
+			r := gen_operand(node.expr, node.ty)
 			add(IR_NEG, r, -1)
+			wrap(node.ty, r)
 			return r
 		}
 	case ND_POST_INC:
@@ -336,6 +636,15 @@ func gen_expr(node *Node) int {
 			nlabel++
 			r := gen_expr(node.cond)
 
+			if node.then == nil {
+				add(IR_IF, r, y)
+				r3 := gen_expr(node.els)
+				add(IR_MOV, r, r3)
+				kill(r3)
+				label(y)
+				return r
+			}
+
 			add(IR_UNLESS, r, x)
 			r2 := gen_expr(node.then)
 			add(IR_MOV, r, r2)
@@ -345,7 +654,7 @@ func gen_expr(node *Node) int {
 			label(x)
 			r3 := gen_expr(node.els)
 			add(IR_MOV, r, r3)
-			kill(r2)
+			kill(r3)
 			label(y)
 			return r
 		}
@@ -373,6 +682,12 @@ func gen_stmt(node *Node) {
 
 	case ND_VARDEF:
 		{
+			if node.inits != nil {
+				for i := 0; i < node.inits.len; i++ {
+					kill(gen_expr(node.inits.data[i].(*Node)))
+				}
+				return
+			}
 			if node.init == nil {
 				return
 			}
@@ -418,17 +733,24 @@ func gen_stmt(node *Node) {
 			y := nlabel
 			nlabel++
 			orig := break_label
+			orig_continue := continue_label
 			break_label = nlabel
 			nlabel++
+			continue_label = nlabel
+			nlabel++
 
 			gen_stmt(node.init)
-			label(x)
+			loop_label(x)
 			if node.cond != nil {
 				r := gen_expr(node.cond)
 				add(IR_UNLESS, r, y)
 				kill(r)
 			}
 			gen_stmt(node.body)
+
+			// `continue` jumps here to run the increment before
+			// testing the condition again.
+			label(continue_label)
 			if node.inc != nil {
 				gen_stmt(node.inc)
 			}
@@ -436,6 +758,7 @@ func gen_stmt(node *Node) {
 			label(y)
 			label(break_label)
 			break_label = orig
+			continue_label = orig_continue
 			return
 		}
 	case ND_DO_WHILE:
@@ -443,22 +766,70 @@ func gen_stmt(node *Node) {
 			x := nlabel
 			nlabel++
 			orig := break_label
+			orig_continue := continue_label
 			break_label = nlabel
 			nlabel++
-			label(x)
+			continue_label = nlabel
+			nlabel++
+			loop_label(x)
 			gen_stmt(node.body)
+			label(continue_label)
 			r := gen_expr(node.cond)
 			add(IR_IF, r, x)
 			kill(r)
 			label(break_label)
 			break_label = orig
+			continue_label = orig_continue
 			return
 		}
-	case ND_BREAK:
-		if break_label == 0 {
-			error("stray 'break' statement")
+	case ND_SWITCH:
+		{
+			orig := break_label
+			break_label = nlabel
+			nlabel++
+
+			// The controlling expression is evaluated only once and
+			// its register is compared against each case value.
+			r := gen_expr(node.cond)
+			for i := 0; i < node.cases.len; i++ {
+				c := node.cases.data[i].(*Node)
+				c.label = nlabel
+				nlabel++
+
+				r2 := nreg
+				nreg++
+				add(IR_IMM, r2, c.val)
+				add(IR_EQ, r2, r)
+				add(IR_IF, r2, c.label)
+				kill(r2)
+			}
+			kill(r)
+
+			if node.default_case != nil {
+				node.default_case.label = nlabel
+				nlabel++
+				jmp(node.default_case.label)
+			} else {
+				jmp(break_label)
+			}
+
+			gen_stmt(node.body)
+			label(break_label)
+			break_label = orig
+			return
 		}
+	case ND_CASE, ND_DEFAULT:
+		label(node.label)
+		gen_stmt(node.body)
+	case ND_BREAK:
 		jmp(break_label)
+	case ND_CONTINUE:
+		jmp(continue_label)
+	case ND_GOTO:
+		jmp(user_label(node.name))
+	case ND_LABEL:
+		label(user_label(node.name))
+		gen_stmt(node.body)
 	case ND_RETURN:
 		{
 			r := gen_expr(node.expr)
@@ -480,7 +851,7 @@ func gen_stmt(node *Node) {
 			kill(gen_expr(node.expr))
 			return
 		}
-	case ND_COMP_STMT:
+	case ND_COMP_STMT, ND_DECL_LIST:
 		{
 			for i := 0; i < node.stmts.len; i++ {
 				gen_stmt((node.stmts.data[i]).(*Node))
@@ -505,16 +876,34 @@ func gen_ir(nodes *Vector) *Vector {
 
 		//assert(node.op == ND_FUNC)
 		code = new_vec()
+		user_labels = new_map()
 
-		for i := 0; i < node.args.len; i++ {
+		if node.is_variadic {
+			for i := 0; i < len(argregs); i++ {
+				ir := add(IR_STORE_ARG, node.va_offset-i*8, i)
+				ir.size = 8
+			}
+		}
+
+		for i := 0; i < node.args.len && i < len(argregs); i++ {
 			arg := node.args.data[i].(*Node)
 			store_arg(arg, arg.offset, i)
 		}
 
 		gen_stmt(node.body)
 
+		// Reaching the closing brace of main returns 0.
+		if node.name == "main" {
+			r := nreg
+			nreg++
+			add(IR_IMM, r, 0)
+			add(IR_RETURN, r, -1)
+			kill(r)
+		}
+
 		fn := new(Function)
 		fn.name = node.name
+		fn.token = node.token
 		fn.stacksize = node.stacksize
 		fn.ir = code
 		fn.globals = node.globals
@@ -4,18 +4,50 @@ package main
 
 import (
 	"fmt"
+	"io"
 )
 
 var (
+	out       io.Writer // where the assembly goes
 	n         int
 	glabel    int
-	regs      = []string{"r10", "r11", "rbx", "r12", "r13", "r14", "r15"}
-	regs8     = []string{"r10b", "r11b", "b1", "r12b", "r13b", "r14b", "r15b"}
-	regs32    = []string{"r10d", "r11d", "ebx", "r12d", "r13d", "r14d", "r15d"}
+	regs      = []string{"r10", "r11", "rbx", "r12", "r13", "r14", "r15", "rbp"}
+	regs8     = []string{"r10b", "r11b", "bl", "r12b", "r13b", "r14b", "r15b", "bpl"}
+	regs16    = []string{"r10w", "r11w", "bx", "r12w", "r13w", "r14w", "r15w", "bp"}
+	regs32    = []string{"r10d", "r11d", "ebx", "r12d", "r13d", "r14d", "r15d", "ebp"}
 	argregs   = []string{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
 	argregs8  = []string{"dil", "sil", "dl", "cl", "r8b", "r9b"}
+	argregs16 = []string{"di", "si", "dx", "cx", "r8w", "r9w"}
 	argregs32 = []string{"edi", "esi", "edx", "ecx", "r8d", "r9d"}
-	num_regs  = len(regs)
+
+	// rbp is allocatable only if the frame pointer is omitted.
+	num_regs = len(regs) - 1
+	reg_rbp  = len(regs) - 1
+
+	// If true, emit a _start entry point so that the output
+	// runs without a C runtime.
+	nostdlib bool
+
+	// If true, emit endbr64 at every function entry for
+	// Intel CET indirect branch tracking.
+	cf_protection bool
+
+	// If true, locals are addressed relative to rsp and rbp is
+	// used as a general-purpose register.
+	omit_frame_pointer bool
+
+	// If true, each function is placed in its own section named
+	// .text.<name>, so that the linker can drop unused functions
+	// with --gc-sections.
+	function_sections bool
+
+	// Distance from rsp to the (virtual) frame base of the current
+	// function when the frame pointer is omitted.
+	frame_base int
+
+	// Bytes pushed onto the stack in the middle of a call sequence,
+	// which move rsp away from the frame base.
+	pushed int
 )
 
 func backslash_escape(s string, length int) string {
@@ -57,6 +89,9 @@ func argreg(r, size int) string {
 	if size == 1 {
 		return argregs8[r]
 	}
+	if size == 2 {
+		return argregs16[r]
+	}
 	if size == 4 {
 		return argregs32[r]
 	}
@@ -65,13 +100,13 @@ func argreg(r, size int) string {
 }
 
 func gen_label() string {
-	buf := fmt.Sprintf(".L%d", n)
+	buf := fmt.Sprintf(".Lx%d", n)
 	n++
 	return buf
 }
 
 func emit(format string, a ...interface{}) {
-	fmt.Printf("\t"+format+"\n", a...)
+	fmt.Fprintf(out, "\t"+format+"\n", a...)
 }
 
 func emit_cmp(ir *IR, insn string) {
@@ -80,10 +115,53 @@ func emit_cmp(ir *IR, insn string) {
 	emit("movzb %s, %s", regs[ir.lhs], regs8[ir.lhs])
 }
 
+// Returns the conditional jump for a comparison, or for its
+// negation if neg is true.
+func jcc(cond int, neg, is_unsigned bool) string {
+	if is_unsigned && cond == IR_LT {
+		if neg {
+			return "jae"
+		}
+		return "jb"
+	}
+	if is_unsigned && cond == IR_LE {
+		if neg {
+			return "ja"
+		}
+		return "jbe"
+	}
+
+	switch cond {
+	case IR_EQ:
+		if neg {
+			return "jne"
+		}
+		return "je"
+	case IR_NE:
+		if neg {
+			return "je"
+		}
+		return "jne"
+	case IR_LT:
+		if neg {
+			return "jge"
+		}
+		return "jl"
+	}
+	// assert(cond == IR_LE)
+	if neg {
+		return "jg"
+	}
+	return "jle"
+}
+
 func reg(r, size int) string {
 	if size == 1 {
 		return regs8[r]
 	}
+	if size == 2 {
+		return regs16[r]
+	}
 	if size == 4 {
 		return regs32[r]
 	}
@@ -91,20 +169,208 @@ func reg(r, size int) string {
 	return regs[r]
 }
 
+// Signed division. The dividend is sign-extended to rdx:rax with
+// cqo (64-bit) or to edx:eax with cdq (32-bit) before idiv.
+// For unsigned division, rdx or edx is cleared and div is used.
+// The quotient is left in rax and the remainder in rdx.
+func emit_div(ir *IR) {
+	if ir.is_imm {
+		emit_div_pow2(ir)
+		return
+	}
+
+	if ir.is_unsigned && ir.size == 8 {
+		emit("mov rax, %s", regs[ir.lhs])
+		emit("xor edx, edx")
+		emit("div %s", regs[ir.rhs])
+	} else if ir.is_unsigned {
+		// Writing a 32-bit register clears the upper half, so
+		// the results are zero-extended.
+		emit("mov eax, %s", regs32[ir.lhs])
+		emit("xor edx, edx")
+		emit("div %s", regs32[ir.rhs])
+	} else if ir.size == 8 {
+		emit("mov rax, %s", regs[ir.lhs])
+		emit("cqo")
+		emit("idiv %s", regs[ir.rhs])
+	} else {
+		emit("mov eax, %s", regs32[ir.lhs])
+		emit("cdq")
+		emit("idiv %s", regs32[ir.rhs])
+		emit("movsxd rax, eax")
+		emit("movsxd rdx, edx")
+	}
+
+	if ir.op == IR_DIV {
+		emit("mov %s, rax", regs[ir.lhs])
+	} else {
+		emit("mov %s, rdx", regs[ir.lhs])
+	}
+}
+
+// Compares ir.size bytes at lhs and rhs one byte at a time
+// and sets lhs to 1 if they are all equal, or 0 otherwise.
+func emit_struct_eq(ir *IR) {
+	loop := gen_label()
+	ne := gen_label()
+	end := gen_label()
+
+	emit("mov rcx, 0")
+	fmt.Fprintf(out, "%s:\n", loop)
+	emit("cmp rcx, %d", ir.size)
+	emit("je %s", end)
+	emit("mov al, [%s+rcx]", regs[ir.lhs])
+	emit("cmp al, [%s+rcx]", regs[ir.rhs])
+	emit("jne %s", ne)
+	emit("inc rcx")
+	emit("jmp %s", loop)
+	fmt.Fprintf(out, "%s:\n", ne)
+	emit("mov rcx, -1")
+	fmt.Fprintf(out, "%s:\n", end)
+	emit("cmp rcx, %d", ir.size)
+	emit("sete %s", regs8[ir.lhs])
+	emit("movzb %s, %s", regs[ir.lhs], regs8[ir.lhs])
+}
+
+// Divides by a power of two with an arithmetic shift. Shifting alone
+// rounds toward negative infinity, so a negative dividend is biased
+// by 2^n-1 first to round toward zero as C requires.
+func emit_div_pow2(ir *IR) {
+	n := ctz(uint(ir.rhs))
+	if ir.size == 8 {
+		emit("mov rax, %s", regs[ir.lhs])
+		emit("sar rax, 63")
+		emit("shr rax, %d", 64-n)
+		emit("add %s, rax", regs[ir.lhs])
+		emit("sar %s, %d", regs[ir.lhs], n)
+		return
+	}
+	emit("mov eax, %s", regs32[ir.lhs])
+	emit("sar eax, 31")
+	emit("shr eax, %d", 32-n)
+	emit("add %s, eax", regs32[ir.lhs])
+	emit("sar %s, %d", regs32[ir.lhs], n)
+	emit("movsxd %s, %s", regs[ir.lhs], regs32[ir.lhs])
+}
+
+// Returns a memory operand of a local variable at a given offset
+// below the frame base. A negative offset refers to an argument
+// passed on the stack.
+func local(off int) string {
+	if omit_frame_pointer {
+		return format("[rsp+%d]", frame_base-off+pushed)
+	}
+	if off < 0 {
+		return format("[rbp+%d]", -off)
+	}
+	return format("[rbp-%d]", off)
+}
+
+// Returns true if the ABI requires a callee to preserve a given
+// physical register. r10 and r11 are the only scratch registers
+// in the pool.
+func is_callee_saved(r int) bool {
+	return regs[r] != "r10" && regs[r] != "r11"
+}
+
+// Returns true if a given physical register appears in a function.
+func uses_reg(fn *Function, r int) bool {
+	for i := 0; i < fn.ir.len; i++ {
+		ir := fn.ir.data[i].(*IR)
+		switch irinfo[ir.op].ty {
+		case IR_TY_BINARY:
+			if ir.lhs == r || (!ir.is_imm && ir.rhs == r) {
+				return true
+			}
+		case IR_TY_REG, IR_TY_REG_IMM, IR_TY_REG_LABEL, IR_TY_LABEL_ADDR:
+			if ir.lhs == r {
+				return true
+			}
+		case IR_TY_MEM, IR_TY_REG_REG, IR_TY_BR:
+			if ir.lhs == r || ir.rhs == r {
+				return true
+			}
+		case IR_TY_CALL:
+			if ir.lhs == r {
+				return true
+			}
+			for j := 0; j < ir.nargs; j++ {
+				if ir.args[j] == r {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Returns the largest number of bytes a call sequence in a function
+// pushes: live registers, stack arguments and alignment padding.
+func outgoing_size(fn *Function) int {
+	size := 0
+	for i := 0; i < fn.ir.len; i++ {
+		ir := fn.ir.data[i].(*IR)
+		if ir.op != IR_CALL {
+			continue
+		}
+		n := roundup((len(ir.live_regs)+len(ir.stack_args))*8, 16)
+		if n > size {
+			size = n
+		}
+	}
+	return size
+}
+
 func gen(fn *Function) {
 
 	ret := format(".Lend%d", glabel)
 	glabel++
 
-	fmt.Printf(".global %s\n", fn.name)
-	fmt.Printf("%s:\n", fn.name)
-	emit("push rbp")
-	emit("mov rbp, rsp")
-	emit("sub rsp, %d", roundup(fn.stacksize, 16))
-	emit("push r12")
-	emit("push r13")
-	emit("push r14")
-	emit("push r15")
+	if function_sections {
+		fmt.Fprintf(out, ".section .text.%s,\"ax\",@progbits\n", fn.name)
+	}
+	fmt.Fprintf(out, ".global %s\n", fn.name)
+	fmt.Fprintf(out, "%s:\n", fn.name)
+	if cf_protection {
+		emit("endbr64")
+	}
+
+	// Callee-saved registers are saved only if the function uses
+	// them. rbp is one of them if the frame pointer is omitted.
+	var saved []string
+	for r := 0; r < len(regs); r++ {
+		if is_callee_saved(r) && uses_reg(fn, r) {
+			saved = append(saved, regs[r])
+		}
+	}
+
+	// The ABI requires rsp to be a multiple of 16 at every call, so
+	// it is 16n+8 at function entry. The return address and saved rbp
+	// make it aligned again, and the frame keeps it so. If an odd
+	// number of registers are saved, the frame is 8 bytes larger.
+	// A call sequence pushes an even number of 8-byte words,
+	// padding if needed.
+	//
+	// Without a frame pointer, the 8 bytes where rbp would be saved
+	// are left as padding so that the frame base is 16-byte aligned
+	// as usual.
+	framesize := roundup(fn.stacksize, 16) + len(saved)%2*8
+	if omit_frame_pointer {
+		frame_base = framesize + len(saved)*8
+		framesize += 8
+		fn.stack_usage = 8 + framesize + len(saved)*8
+	} else {
+		emit("push rbp")
+		emit("mov rbp, rsp")
+		fn.stack_usage = 16 + framesize + len(saved)*8
+	}
+	fn.stack_usage += outgoing_size(fn)
+	if framesize != 0 {
+		emit("sub rsp, %d", framesize)
+	}
+	for _, r := range saved {
+		emit("push %s", r)
+	}
 
 	for i := 0; i < fn.ir.len; i++ {
 		ir := fn.ir.data[i].(*IR)
@@ -115,7 +381,7 @@ func gen(fn *Function) {
 		case IR_IMM:
 			emit("mov %s, %d", regs[lhs], rhs)
 		case IR_BPREL:
-			emit("lea %s, [rbp-%d]", regs[lhs], rhs)
+			emit("lea %s, %s", regs[lhs], local(rhs))
 		case IR_MOV:
 			emit("mov %s, %s", regs[lhs], regs[rhs])
 		case IR_RETURN:
@@ -123,31 +389,68 @@ func gen(fn *Function) {
 			emit("jmp %s", ret)
 		case IR_CALL:
 			{
+				for _, r := range ir.live_regs {
+					emit("push %s", regs[r])
+				}
+
+				// Arguments after the sixth are pushed from right
+				// to left. rsp must stay 16-byte aligned at the call.
+				nstack := len(ir.stack_args)
+				pad := (len(ir.live_regs) + nstack) % 2 * 8
+				if pad != 0 {
+					emit("sub rsp, %d", pad)
+				}
+				pushed = len(ir.live_regs)*8 + pad
+				for i := nstack - 1; i >= 0; i-- {
+					emit("push qword ptr %s", local(ir.stack_args[i]))
+					pushed += 8
+				}
+				pushed = 0
+
 				for i := 0; i < ir.nargs; i++ {
 					emit("mov %s, %s", argregs[i], regs[ir.args[i]])
 				}
-				emit("push r10")
-				emit("push r11")
-				emit("mov rax, 0")
+				if ir.is_variadic {
+					emit("mov eax, 0")
+				}
 				emit("call %s", ir.name)
-				emit("pop r11")
-				emit("pop r10")
+				if nstack*8+pad != 0 {
+					emit("add rsp, %d", nstack*8+pad)
+				}
+				for j := len(ir.live_regs) - 1; j >= 0; j-- {
+					emit("pop %s", regs[ir.live_regs[j]])
+				}
 				emit("mov %s, rax", regs[lhs])
 			}
 		case IR_LABEL:
-			fmt.Printf(".L%d:\n", lhs)
+			// Aligning a loop top lets the CPU fetch the loop
+			// body in fewer cycles on every iteration.
+			if ir.is_loop && opt_level > 0 {
+				fmt.Fprintf(out, ".p2align 4\n")
+			}
+			fmt.Fprintf(out, ".L%d:\n", lhs)
 		case IR_LABEL_ADDR:
 			emit("lea %s, %s", regs[lhs], ir.name)
 		case IR_NEG:
 			emit("neg %s", regs[lhs])
+		case IR_NOT:
+			emit("not %s", regs[lhs])
 		case IR_EQ:
 			emit_cmp(ir, "sete")
 		case IR_NE:
 			emit_cmp(ir, "setne")
 		case IR_LT:
-			emit_cmp(ir, "setl")
+			if ir.is_unsigned {
+				emit_cmp(ir, "setb")
+			} else {
+				emit_cmp(ir, "setl")
+			}
 		case IR_LE:
-			emit_cmp(ir, "setle")
+			if ir.is_unsigned {
+				emit_cmp(ir, "setbe")
+			} else {
+				emit_cmp(ir, "setle")
+			}
 		case IR_AND:
 			emit("and %s, %s", regs[lhs], regs[rhs])
 		case IR_OR:
@@ -159,11 +462,26 @@ func gen(fn *Function) {
 				emit("xor %s, %s", regs[lhs], regs[rhs])
 			}
 		case IR_SHL:
+			if ir.is_imm {
+				emit("shl %s, %d", regs[lhs], rhs)
+				break
+			}
 			emit("mov cl, %s", regs8[rhs])
 			emit("shl %s, cl", regs[lhs])
 		case IR_SHR:
+			if ir.is_imm {
+				emit("shr %s, %d", regs[lhs], rhs)
+				break
+			}
 			emit("mov cl, %s", regs8[rhs])
 			emit("shr %s, cl", regs[lhs])
+		case IR_SAR:
+			if ir.is_imm {
+				emit("sar %s, %d", regs[lhs], rhs)
+				break
+			}
+			emit("mov cl, %s", regs8[rhs])
+			emit("sar %s, cl", regs[lhs])
 		case IR_JMP:
 			emit("jmp .L%d", lhs)
 		case IR_IF:
@@ -172,15 +490,36 @@ func gen(fn *Function) {
 		case IR_UNLESS:
 			emit("cmp %s, 0", regs[lhs])
 			emit("je .L%d", rhs)
+		case IR_BR:
+			emit("cmp %s, %s", regs[lhs], regs[rhs])
+			emit("%s .L%d", jcc(ir.cond, ir.is_neg, ir.is_unsigned), ir.label)
 		case IR_LOAD:
-			emit("mov %s, [%s]", reg(lhs, ir.size), regs[rhs])
-			if ir.size == 1 {
-				emit("movzb %s, %s", regs[lhs], regs8[lhs])
+			// Values narrower than a register are sign-extended so that
+			// 64-bit comparisons and arithmetic see the right sign.
+			// Unsigned ones are zero-extended.
+			if ir.is_unsigned && ir.size == 1 {
+				emit("movzx %s, byte ptr [%s]", regs[lhs], regs[rhs])
+			} else if ir.is_unsigned && ir.size == 2 {
+				emit("movzx %s, word ptr [%s]", regs[lhs], regs[rhs])
+			} else if ir.is_unsigned && ir.size == 4 {
+				emit("mov %s, dword ptr [%s]", regs32[lhs], regs[rhs])
+			} else if ir.size == 1 {
+				emit("movsx %s, byte ptr [%s]", regs[lhs], regs[rhs])
+			} else if ir.size == 2 {
+				emit("movsx %s, word ptr [%s]", regs[lhs], regs[rhs])
+			} else if ir.size == 4 {
+				emit("movsxd %s, dword ptr [%s]", regs[lhs], regs[rhs])
+			} else {
+				emit("mov %s, [%s]", regs[lhs], regs[rhs])
 			}
 		case IR_STORE:
 			emit("mov [%s], %s", regs[lhs], reg(rhs, ir.size))
 		case IR_STORE_ARG:
-			emit("mov [rbp-%d], %s", lhs, argreg(rhs, ir.size))
+			emit("mov %s, %s", local(lhs), argreg(rhs, ir.size))
+		case IR_LOAD_SPILL:
+			emit("mov %s, %s", regs[lhs], local(rhs))
+		case IR_STORE_SPILL:
+			emit("mov %s, %s", local(rhs), regs[lhs])
 		case IR_ADD:
 			if ir.is_imm {
 				emit("add %s, %d", regs[lhs], rhs)
@@ -207,16 +546,18 @@ func gen(fn *Function) {
 			emit("mov rax, %d", rhs)
 			emit("mul %s", regs[lhs])
 			emit("mov %s, rax", regs[lhs])
-		case IR_DIV:
-			emit("mov rax, %s", regs[lhs])
-			emit("cqo")
-			emit("div %s", regs[rhs])
-			emit("mov %s, rax", regs[lhs])
-		case IR_MOD:
-			emit("mov rax, %s", regs[lhs])
-			emit("cqo")
-			emit("div %s", regs[rhs])
-			emit("mov %s, rdx", regs[lhs])
+		case IR_DIV, IR_MOD:
+			emit_div(ir)
+		case IR_STRUCT_EQ:
+			emit_struct_eq(ir)
+		case IR_TRAP:
+			emit("ud2")
+		case IR_UNREACHABLE:
+			// Control never reaches here, so instructions up to the
+			// next label are dead.
+			for i+1 < fn.ir.len && fn.ir.data[i+1].(*IR).op != IR_LABEL {
+				i++
+			}
 		case IR_NOP:
 			break
 		default:
@@ -224,31 +565,97 @@ func gen(fn *Function) {
 		}
 	}
 
-	fmt.Printf("%s:\n", ret)
-	emit("pop r15")
-	emit("pop r14")
-	emit("pop r13")
-	emit("pop r12")
-	emit("mov rsp, rbp")
-	emit("pop rbp")
+	fmt.Fprintf(out, "%s:\n", ret)
+	for i := len(saved) - 1; i >= 0; i-- {
+		emit("pop %s", saved[i])
+	}
+	if omit_frame_pointer {
+		if framesize != 0 {
+			emit("add rsp, %d", framesize)
+		}
+	} else {
+		emit("mov rsp, rbp")
+		emit("pop rbp")
+	}
 	emit("ret")
 }
 
-func gen_x86(globals, fns *Vector) {
+// The kernel enters _start with argc at [rsp] followed by argv.
+// rsp is 16-byte aligned there, so calling main keeps the ABI's
+// alignment. main's return value is passed to the exit syscall.
+func emit_start() {
+	fmt.Fprintf(out, ".global _start\n")
+	fmt.Fprintf(out, "_start:\n")
+	if cf_protection {
+		emit("endbr64")
+	}
+	emit("xor rbp, rbp")
+	emit("mov rdi, [rsp]")
+	emit("lea rsi, [rsp+8]")
+	emit("and rsp, -16")
+	emit("call main")
+	emit("mov edi, eax")
+	emit("mov eax, 60")
+	emit("syscall")
+}
 
-	fmt.Printf(".intel_syntax noprefix\n")
+// Prints the stack usage of each function in the format of
+// GCC's -fstack-usage.
+func print_stack_usage(w io.Writer, fns *Vector) {
+	for i := 0; i < fns.len; i++ {
+		fn := fns.data[i].(*Function)
+		t := fn.token
+		if t.line == 0 {
+			fmt.Fprintf(w, "%s:%s\t%d\tstatic\n", t.path, fn.name, fn.stack_usage)
+			continue
+		}
+		fmt.Fprintf(w, "%s:%d:%d:%s\t%d\tstatic\n", t.path, t.line, t.col, fn.name, fn.stack_usage)
+	}
+}
+
+// Returns the assembler directive that emits an integer of a given size.
+func data_directive(size int) string {
+	switch size {
+	case 1:
+		return ".byte"
+	case 2:
+		return ".short"
+	case 4:
+		return ".long"
+	}
+	return ".quad"
+}
+
+func gen_x86(w io.Writer, globals, fns *Vector) {
+	out = w
 
-	fmt.Printf(".data\n")
+	fmt.Fprintf(out, ".intel_syntax noprefix\n")
+
+	fmt.Fprintf(out, ".data\n")
 	for i := 0; i < globals.len; i++ {
 		v := globals.data[i].(*Var)
 		if v.is_extern {
 			continue
 		}
-		fmt.Printf("%s:\n", v.name)
-		emit(".ascii \"%s\"", backslash_escape(v.data, v.len))
+		if v.ty.align > 1 {
+			fmt.Fprintf(out, ".align %d\n", v.ty.align)
+		}
+		fmt.Fprintf(out, "%s:\n", v.name)
+		if v.reloc != "" {
+			emit(".quad %s", v.reloc)
+		} else if v.has_val {
+			emit("%s %d", data_directive(v.ty.size), v.val)
+		} else if v.len == 0 {
+			emit(".zero %d", v.ty.size)
+		} else {
+			emit(".ascii \"%s\"", backslash_escape(v.data, v.len))
+		}
 	}
 
-	fmt.Printf(".text\n")
+	fmt.Fprintf(out, ".text\n")
+	if nostdlib {
+		emit_start()
+	}
 	for i := 0; i < fns.len; i++ {
 		gen(fns.data[i].(*Function))
 	}
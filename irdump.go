@@ -6,37 +6,45 @@ import (
 )
 
 var irinfo = map[int]IRInfo{
-	IR_ADD:        {name: "ADD", ty: IR_TY_BINARY},
-	IR_CALL:       {name: "CALL", ty: IR_TY_CALL},
-	IR_DIV:        {name: "DIV", ty: IR_TY_REG_REG},
-	IR_IMM:        {name: "IMM", ty: IR_TY_REG_IMM},
-	IR_JMP:        {name: "JMP", ty: IR_TY_JMP},
-	IR_KILL:       {name: "KILL", ty: IR_TY_REG},
-	IR_LABEL:      {name: "", ty: IR_TY_LABEL},
-	IR_LABEL_ADDR: {name: "LABEL_ADDR", ty: IR_TY_LABEL_ADDR},
-	IR_EQ:         {name: "EQ", ty: IR_TY_REG_REG},
-	IR_NE:         {name: "NE", ty: IR_TY_REG_REG},
-	IR_LE:         {name: "LE", ty: IR_TY_REG_REG},
-	IR_LT:         {name: "LT", ty: IR_TY_REG_REG},
-	IR_AND:        {name: "AND", ty: IR_TY_REG_REG},
-	IR_OR:         {name: "OR", ty: IR_TY_REG_REG},
-	IR_XOR:        {name: "XOR", ty: IR_TY_BINARY},
-	IR_SHL:        {name: "SHL", ty: IR_TY_REG_REG},
-	IR_SHR:        {name: "SHR", ty: IR_TY_REG_REG},
-	IR_LOAD:       {name: "LOAD", ty: IR_TY_MEM},
-	IR_MOD:        {name: "MOD", ty: IR_TY_REG_REG},
-	IR_NEG:        {name: "NEG", ty: IR_TY_REG},
-	IR_MOV:        {name: "MOV", ty: IR_TY_REG_REG},
-	IR_MUL:        {name: "MUL", ty: IR_TY_BINARY},
-	IR_NOP:        {name: "NOP", ty: IR_TY_NOARG},
-	IR_RETURN:     {name: "RET", ty: IR_TY_REG},
-	IR_STORE:      {name: "STORE", ty: IR_TY_MEM},
-	IR_STORE_ARG:  {name: "STORE_ARG", ty: IR_TY_STORE_ARG},
-	IR_SUB:        {name: "SUB", ty: IR_TY_BINARY},
-	IR_BPREL:      {name: "BPREL", ty: IR_TY_REG_IMM},
-	IR_IF:         {name: "IF", ty: IR_TY_REG_LABEL},
-	IR_UNLESS:     {name: "UNLESS", ty: IR_TY_REG_LABEL},
-	0:             {name: "", ty: 0},
+	IR_ADD:         {name: "ADD", ty: IR_TY_BINARY},
+	IR_CALL:        {name: "CALL", ty: IR_TY_CALL},
+	IR_DIV:         {name: "DIV", ty: IR_TY_BINARY},
+	IR_IMM:         {name: "IMM", ty: IR_TY_REG_IMM},
+	IR_JMP:         {name: "JMP", ty: IR_TY_JMP},
+	IR_KILL:        {name: "KILL", ty: IR_TY_REG},
+	IR_LABEL:       {name: "", ty: IR_TY_LABEL},
+	IR_LABEL_ADDR:  {name: "LABEL_ADDR", ty: IR_TY_LABEL_ADDR},
+	IR_EQ:          {name: "EQ", ty: IR_TY_REG_REG},
+	IR_NE:          {name: "NE", ty: IR_TY_REG_REG},
+	IR_LE:          {name: "LE", ty: IR_TY_REG_REG},
+	IR_LT:          {name: "LT", ty: IR_TY_REG_REG},
+	IR_AND:         {name: "AND", ty: IR_TY_REG_REG},
+	IR_OR:          {name: "OR", ty: IR_TY_REG_REG},
+	IR_XOR:         {name: "XOR", ty: IR_TY_BINARY},
+	IR_SHL:         {name: "SHL", ty: IR_TY_BINARY},
+	IR_SHR:         {name: "SHR", ty: IR_TY_BINARY},
+	IR_SAR:         {name: "SAR", ty: IR_TY_BINARY},
+	IR_LOAD:        {name: "LOAD", ty: IR_TY_MEM},
+	IR_MOD:         {name: "MOD", ty: IR_TY_REG_REG},
+	IR_NEG:         {name: "NEG", ty: IR_TY_REG},
+	IR_NOT:         {name: "NOT", ty: IR_TY_REG},
+	IR_MOV:         {name: "MOV", ty: IR_TY_REG_REG},
+	IR_MUL:         {name: "MUL", ty: IR_TY_BINARY},
+	IR_NOP:         {name: "NOP", ty: IR_TY_NOARG},
+	IR_TRAP:        {name: "TRAP", ty: IR_TY_NOARG},
+	IR_UNREACHABLE: {name: "UNREACHABLE", ty: IR_TY_NOARG},
+	IR_STRUCT_EQ:   {name: "STRUCT_EQ", ty: IR_TY_MEM},
+	IR_RETURN:      {name: "RET", ty: IR_TY_REG},
+	IR_STORE:       {name: "STORE", ty: IR_TY_MEM},
+	IR_STORE_ARG:   {name: "STORE_ARG", ty: IR_TY_STORE_ARG},
+	IR_LOAD_SPILL:  {name: "LOAD_SPILL", ty: IR_TY_REG_IMM},
+	IR_STORE_SPILL: {name: "STORE_SPILL", ty: IR_TY_REG_IMM},
+	IR_SUB:         {name: "SUB", ty: IR_TY_BINARY},
+	IR_BPREL:       {name: "BPREL", ty: IR_TY_REG_IMM},
+	IR_IF:          {name: "IF", ty: IR_TY_REG_LABEL},
+	IR_UNLESS:      {name: "UNLESS", ty: IR_TY_REG_LABEL},
+	IR_BR:          {name: "BR", ty: IR_TY_BR},
+	0:              {name: "", ty: 0},
 }
 
 func tostr(ir *IR) string {
@@ -56,10 +64,13 @@ func tostr(ir *IR) string {
 	case IR_TY_REG:
 		return format("\t%s r%d", info.name, ir.lhs)
 	case IR_TY_JMP:
-		return format("\t%s r%d", info.name, ir.lhs)
+		return format("\t%s .L%d", info.name, ir.lhs)
 	case IR_TY_REG_REG:
 		return format("\t%s r%d, r%d", info.name, ir.lhs, ir.rhs)
 	case IR_TY_MEM:
+		if ir.is_volatile {
+			return format("\t%s%d r%d, r%d (volatile)", info.name, ir.size, ir.lhs, ir.rhs)
+		}
 		return format("\t%s%d r%d, r%d", info.name, ir.size, ir.lhs, ir.rhs)
 	case IR_TY_REG_IMM:
 		return format("\t%s r%d, %d", info.name, ir.lhs, ir.rhs)
@@ -67,24 +78,35 @@ func tostr(ir *IR) string {
 		return format("\t%s%d %d, %d", info.name, ir.size, ir.lhs, ir.rhs)
 	case IR_TY_REG_LABEL:
 		return format("\t%s r%d, .L%d", info.name, ir.lhs, ir.rhs)
+	case IR_TY_BR:
+		neg := ""
+		if ir.is_neg {
+			neg = "!"
+		}
+		return format("\t%s %s%s r%d, r%d, .L%d", info.name, neg, irinfo[ir.cond].name, ir.lhs, ir.rhs, ir.label)
 	case IR_TY_CALL:
 		{
 			sb := new_sb()
-			sb_append(sb, format("r%d = %s(", ir.lhs, ir.name))
+			sb_append(sb, format("\tr%d = %s(", ir.lhs, ir.name))
 			for i := 0; i < ir.nargs; i++ {
 				if i != 0 {
 					sb_append(sb, ", ")
 				}
 				sb_append(sb, format("r%d", ir.args[i]))
 			}
-			sb_append(sb, ")\n")
+			for i := 0; i < len(ir.stack_args); i++ {
+				if i != 0 || ir.nargs != 0 {
+					sb_append(sb, ", ")
+				}
+				sb_append(sb, format("[%d]", ir.stack_args[i]))
+			}
+			sb_append(sb, ")")
 			return sb_get(sb)
 		}
 	default:
 		//asset(info.ty == IR_TY_NOARG)
 		return format("\t%s", info.name)
 	}
-	return ""
 }
 
 func dump_ir(irv *Vector) {
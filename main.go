@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func main() {
@@ -16,31 +20,79 @@ func main() {
 	}
 
 	path := ""
+	output := ""
 	dump_ir1 := false
 	dump_ir2 := false
+	syntax_only := false
+	stack_usage := false
 
-	if len(os.Args) == 3 && os.Args[1] == "-dump-ir1" {
-		dump_ir1 = true
-		path = os.Args[2]
-	} else if len(os.Args) == 3 && os.Args[1] == "-dump-ir2" {
-		dump_ir2 = true
-		path = os.Args[2]
-	} else {
-		if len(os.Args) != 2 {
-			usage()
+	args := expand_args(os.Args[1:], new_map())
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-o":
+			if i+1 == len(args) {
+				usage()
+			}
+			i++
+			output = args[i]
+		case "-dump-ir", "-dump-ir1":
+			dump_ir1 = true
+		case "-dump-ir2":
+			dump_ir2 = true
+		case "-fsyntax-only":
+			syntax_only = true
+		case "-nostdlib":
+			nostdlib = true
+		case "-fcf-protection":
+			cf_protection = true
+		case "-fomit-frame-pointer":
+			omit_frame_pointer = true
+		case "-ffunction-sections":
+			function_sections = true
+		case "-fstack-usage":
+			stack_usage = true
+		case "-O0":
+			opt_level = 0
+		case "-O1":
+			opt_level = 1
+		default:
+			if path != "" {
+				usage()
+			}
+			path = arg
 		}
-		path = os.Args[1]
+	}
+	if path == "" {
+		usage()
 	}
 
-	// Tokenize and parse.
-	tokens := tokenize(path, true)
+	// Tokenize and parse. The argument is read as follows:
+	//
+	//  1. "-" reads source code from stdin.
+	//  2. An existing file or a name ending with ".c" is read as
+	//     a file. It is an error if it cannot be read.
+	//  3. Anything else is compiled as source code, which is handy
+	//     for quick tests.
+	var tokens *Vector
+	if path == "-" || is_src_file(path) {
+		tokens = tokenize(path, true)
+	} else {
+		tokens = tokenize_buf("<command line>", path+"\n", true)
+	}
 	if debug {
 		print_tokens(tokens)
 	}
 	nodes := parse(tokens)
 	globals := sema(nodes)
+	if syntax_only {
+		return
+	}
 	fns := gen_ir(nodes)
+	optimize(fns)
 
+	// -dump-ir (or -dump-ir1) prints IR to stderr before register
+	// allocation, and -dump-ir2 after it.
 	if dump_ir1 {
 		dump_ir(fns)
 	}
@@ -50,7 +102,76 @@ func main() {
 		dump_ir(fns)
 	}
 
-	gen_x86(globals, fns)
+	// Assembly goes to stdout unless -o is given.
+	f := os.Stdout
+	if output != "" {
+		f2, err := os.Create(output)
+		if err != nil {
+			error("cannot open %s: %v", output, err.(*os.PathError).Err)
+		}
+		f = f2
+		defer f2.Close()
+	}
+	w := bufio.NewWriter(f)
+	gen_x86(w, globals, fns)
+	w.Flush()
+
+	// -fstack-usage writes foo.su for foo.c like GCC, or to stderr
+	// if the source is not a file.
+	if stack_usage {
+		if !is_src_file(path) {
+			print_stack_usage(os.Stderr, fns)
+			return
+		}
+		su := strings.TrimSuffix(filepath.Base(path), ".c") + ".su"
+		f2, err := os.Create(su)
+		if err != nil {
+			error("cannot open %s: %v", su, err.(*os.PathError).Err)
+		}
+		print_stack_usage(f2, fns)
+		f2.Close()
+	}
+}
+
+// Replaces each "@file" argument with the arguments written in
+// that file, separated by whitespace. Build systems use this to
+// avoid command-line length limits. A response file may refer to
+// another one; active keeps the files being expanded to detect
+// cycles.
+func expand_args(args []string, active *Map) []string {
+	var v []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+			v = append(v, arg)
+			continue
+		}
+
+		path := arg[1:]
+		if map_geti(active, path, 0) == 1 {
+			error("%s: response file includes itself", path)
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			error("cannot open %s: %v", path, err.(*os.PathError).Err)
+		}
+		map_puti(active, path, 1)
+		v = append(v, expand_args(strings.Fields(string(buf)), active)...)
+		map_puti(active, path, 0)
+	}
+	return v
+}
+
+func is_src_file(path string) bool {
+	return is_file(path) || strings.HasSuffix(path, ".c")
 }
 
-func usage() { error("Usage: 9ccgo [-test] [-dump-ir1] [-dump-ir2] <file>") }
+func is_file(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: 9ccgo [-test] [-dump-ir] [-dump-ir1] [-dump-ir2] [-O0] [-O1] [-fsyntax-only] [-nostdlib] [-fcf-protection] [-fomit-frame-pointer] [-ffunction-sections] [-fstack-usage] [-o <output>] [@file] <file>")
+	fmt.Fprintln(os.Stderr, "Exit status is 1 if the program does not compile and 2 on a usage error.")
+	os.Exit(EXIT_USAGE)
+}
@@ -0,0 +1,587 @@
+package main
+
+// Optimizer. This pass runs on IR before register allocation
+// and is enabled by -O1.
+//
+// It eliminates common subexpressions by local value numbering.
+// Each value computed in a basic block gets a number, and two
+// instructions that apply the same operator to the same value
+// numbers compute the same value. If a register that still holds
+// the value is alive, the second computation is replaced with a
+// register-to-register move.
+//
+// Loads are numbered together with a memory generation which is
+// bumped by every store or function call, so a write to memory
+// invalidates all values loaded before it. Volatile loads are
+// never reused.
+//
+// Arithmetic on constants is folded into a single IR_IMM, and the
+// IR_IMMs that become dead by that are removed.
+//
+// It also replaces multiplications and divisions by power-of-two
+// constants with shifts, and merges labels that are next to each
+// other into one.
+//
+// A comparison whose result is only tested by a branch is fused
+// with the branch into IR_BR, so that no 0/1 value is made.
+//
+// Finally, instructions that compute a value nobody reads are
+// removed, along with the IR_NOPs left by the other passes.
+
+import (
+	"math"
+)
+
+var (
+	opt_level int
+
+	exprs  *Map  // expression -> value number
+	reg_vn []int // register -> value number
+	vn_reg []int // value number -> register holding it
+	memgen int
+
+	is_const   []bool // register -> true if it holds a known constant
+	const_val  []int
+	const_def  []int  // register -> index of the IR_IMM defining it
+	const_read []bool // register -> true if read since defined
+	nread      []int  // register -> number of reads
+)
+
+func new_vn() int {
+	vn_reg = append(vn_reg, 0)
+	return len(vn_reg) - 1
+}
+
+func vn_of(r int) int {
+	if reg_vn[r] == 0 {
+		reg_vn[r] = new_vn()
+		vn_reg[reg_vn[r]] = r
+	}
+	return reg_vn[r]
+}
+
+// Forgets everything we know. Called at the beginning of
+// a basic block since it may be reached from multiple places.
+func reset_vn() {
+	exprs = new_map()
+	for i := range reg_vn {
+		reg_vn[i] = 0
+	}
+	vn_reg = vn_reg[:1]
+}
+
+func is_commutative(op int) bool {
+	switch op {
+	case IR_ADD, IR_MUL, IR_AND, IR_OR, IR_XOR, IR_EQ, IR_NE:
+		return true
+	}
+	return false
+}
+
+// Assigns a value number to the result of ir. If the same value
+// is in a live register and reuse is true, ir becomes a move.
+func number_vn(ir *IR, key string, reuse bool) {
+	vn := map_geti(exprs, key, 0)
+	if vn == 0 {
+		vn = new_vn()
+		map_puti(exprs, key, vn)
+	}
+
+	h := vn_reg[vn]
+	if reuse && h != 0 && h != ir.lhs && reg_vn[h] == vn {
+		ir.op = IR_MOV
+		ir.rhs = h
+		ir.is_imm = false
+		ir.size = 0
+	}
+
+	reg_vn[ir.lhs] = vn
+	if h == 0 || reg_vn[h] != vn {
+		vn_reg[vn] = ir.lhs
+	}
+}
+
+func define_vn(r int) {
+	reg_vn[r] = new_vn()
+	vn_reg[reg_vn[r]] = r
+}
+
+func cse(irv *Vector) {
+	reset_vn()
+
+	for i := 0; i < irv.len; i++ {
+		ir := irv.data[i].(*IR)
+
+		switch ir.op {
+		case IR_LABEL:
+			reset_vn()
+		case IR_IMM:
+			number_vn(ir, format("imm %d", ir.rhs), false)
+		case IR_BPREL:
+			number_vn(ir, format("bprel %d", ir.rhs), false)
+		case IR_LABEL_ADDR:
+			number_vn(ir, format("label %s", ir.name), false)
+		case IR_MOV:
+			reg_vn[ir.lhs] = vn_of(ir.rhs)
+		case IR_LOAD:
+			if ir.is_volatile {
+				define_vn(ir.lhs)
+				break
+			}
+			key := format("load%d %t %d %d", ir.size, ir.is_unsigned, vn_of(ir.rhs), memgen)
+			number_vn(ir, key, true)
+		case IR_NEG:
+			number_vn(ir, format("neg %d", vn_of(ir.lhs)), true)
+		case IR_NOT:
+			number_vn(ir, format("not %d", vn_of(ir.lhs)), true)
+		case IR_ADD, IR_SUB, IR_MUL, IR_DIV, IR_MOD, IR_EQ, IR_NE, IR_LE, IR_LT,
+			IR_AND, IR_OR, IR_XOR, IR_SHL, IR_SHR, IR_SAR:
+			a := vn_of(ir.lhs)
+			if ir.is_imm {
+				number_vn(ir, format("%d %d imm %d %d %t", ir.op, a, ir.rhs, ir.size, ir.is_unsigned), true)
+				break
+			}
+			b := vn_of(ir.rhs)
+			if is_commutative(ir.op) && b < a {
+				a, b = b, a
+			}
+			number_vn(ir, format("%d %d %d %d %t", ir.op, a, b, ir.size, ir.is_unsigned), true)
+		case IR_STORE, IR_STORE_ARG:
+			memgen++
+		case IR_CALL:
+			memgen++
+			define_vn(ir.lhs)
+		case IR_STRUCT_EQ:
+			define_vn(ir.lhs)
+		case IR_KILL:
+			reg_vn[ir.lhs] = 0
+		}
+	}
+}
+
+// Returns the registers an instruction reads.
+func reg_reads(ir *IR) []int {
+	if ir.op == IR_KILL {
+		return nil
+	}
+
+	var v []int
+	for i, p := range reg_operands(ir) {
+		if i == 0 {
+			switch ir.op {
+			case IR_IMM, IR_BPREL, IR_LABEL_ADDR, IR_MOV, IR_LOAD, IR_CALL:
+				continue
+			}
+		}
+		v = append(v, *p)
+	}
+	return v
+}
+
+// Returns true if ir does nothing but compute its lhs register.
+// Division is not pure because it may trap.
+func is_pure(ir *IR) bool {
+	switch ir.op {
+	case IR_IMM, IR_BPREL, IR_LABEL_ADDR, IR_MOV, IR_ADD, IR_SUB, IR_MUL,
+		IR_EQ, IR_NE, IR_LE, IR_LT, IR_AND, IR_OR, IR_XOR, IR_SHL, IR_SHR,
+		IR_SAR, IR_NEG, IR_NOT:
+		return true
+	case IR_LOAD:
+		return !ir.is_volatile
+	}
+	return false
+}
+
+// Removes pure instructions whose result is never read before it is
+// overwritten, and then all IR_NOPs. Liveness is computed backward
+// within a basic block. Nothing is live after IR_RETURN. At a label
+// or a jump, a register is assumed to be live unless no instruction
+// in the function reads it.
+func eliminate_dead_code(fn *Function) {
+	irv := fn.ir
+	for i := range nread {
+		nread[i] = 0
+	}
+	for i := 0; i < irv.len; i++ {
+		for _, r := range reg_reads(irv.data[i].(*IR)) {
+			nread[r]++
+		}
+	}
+
+	dead := make([]bool, len(nread))
+	reset := func(all bool) {
+		for r := range dead {
+			dead[r] = all || nread[r] == 0
+		}
+	}
+	reset(true)
+
+	for i := irv.len - 1; i >= 0; i-- {
+		ir := irv.data[i].(*IR)
+
+		if ir.op == IR_RETURN {
+			reset(true)
+		} else if ir.op == IR_LABEL || jump_target(ir) != 0 {
+			reset(false)
+		}
+		if ir.op == IR_KILL || ir.op == IR_NOP {
+			continue
+		}
+
+		if is_pure(ir) && dead[ir.lhs] {
+			for _, r := range reg_reads(ir) {
+				nread[r]--
+			}
+			ir.op = IR_NOP
+			continue
+		}
+
+		if len(reg_operands(ir)) > 0 && writes_lhs(ir.op) {
+			dead[ir.lhs] = true
+		}
+		for _, r := range reg_reads(ir) {
+			dead[r] = false
+		}
+	}
+
+	v := new_vec()
+	for i := 0; i < irv.len; i++ {
+		if ir := irv.data[i].(*IR); ir.op != IR_NOP {
+			vec_push(v, ir)
+		}
+	}
+	fn.ir = v
+}
+
+// Computes `a op b` as gen_x86 would. Returns false if it cannot be
+// computed at compile time because the division would trap.
+func eval_binop(op, size int, is_unsigned bool, a, b int) (int, bool) {
+	switch op {
+	case IR_ADD:
+		return a + b, true
+	case IR_SUB:
+		return a - b, true
+	case IR_MUL:
+		return a * b, true
+	case IR_DIV:
+		if is_unsigned && size == 8 {
+			if b == 0 {
+				return 0, false
+			}
+			return int(uint64(a) / uint64(b)), true
+		}
+		if is_unsigned {
+			if uint32(b) == 0 {
+				return 0, false
+			}
+			return int(uint32(a) / uint32(b)), true
+		}
+		if size == 8 {
+			if b == 0 || (a == math.MinInt64 && b == -1) {
+				return 0, false
+			}
+			return a / b, true
+		}
+		x, y := int32(a), int32(b)
+		if y == 0 || (x == math.MinInt32 && y == -1) {
+			return 0, false
+		}
+		return int(x / y), true
+	}
+	return 0, false
+}
+
+// Folds arithmetic whose operands are constants into IR_IMM.
+// Returns true if anything is folded.
+func fold_constants(irv *Vector) bool {
+	for i := range nread {
+		nread[i] = 0
+	}
+	for i := 0; i < irv.len; i++ {
+		for _, r := range reg_reads(irv.data[i].(*IR)) {
+			nread[r]++
+		}
+	}
+
+	for i := range is_const {
+		is_const[i] = false
+	}
+	changed := false
+
+	for i := 0; i < irv.len; i++ {
+		ir := irv.data[i].(*IR)
+
+		switch ir.op {
+		case IR_LABEL:
+			for i := range is_const {
+				is_const[i] = false
+			}
+			continue
+		case IR_ADD, IR_SUB, IR_MUL, IR_DIV:
+			if !is_const[ir.lhs] || (!ir.is_imm && !is_const[ir.rhs]) {
+				break
+			}
+			b := ir.rhs
+			if !ir.is_imm {
+				b = const_val[ir.rhs]
+			}
+			val, ok := eval_binop(ir.op, ir.size, ir.is_unsigned, const_val[ir.lhs], b)
+			if !ok {
+				break
+			}
+
+			// The old value of lhs is dead if nothing else has
+			// read it, and so is rhs if this is its only reader.
+			if !const_read[ir.lhs] {
+				irv.data[const_def[ir.lhs]].(*IR).op = IR_NOP
+			}
+			nread[ir.lhs]--
+			if !ir.is_imm {
+				nread[ir.rhs]--
+				if nread[ir.rhs] == 0 {
+					irv.data[const_def[ir.rhs]].(*IR).op = IR_NOP
+				}
+			}
+
+			ir.op = IR_IMM
+			ir.rhs = val
+			ir.is_imm = false
+			changed = true
+		}
+
+		// A value may be read where a jump goes, so a jump
+		// counts as a read of everything.
+		if jump_target(ir) != 0 {
+			for i := range const_read {
+				const_read[i] = true
+			}
+		}
+		for _, r := range reg_reads(ir) {
+			const_read[r] = true
+		}
+
+		if ir.op == IR_IMM {
+			is_const[ir.lhs] = true
+			const_val[ir.lhs] = ir.rhs
+			const_def[ir.lhs] = i
+			const_read[ir.lhs] = false
+		} else if len(reg_operands(ir)) > 0 && writes_lhs(ir.op) {
+			is_const[ir.lhs] = false
+		}
+	}
+	return changed
+}
+
+func is_pow2(x int) bool {
+	return x >= 2 && popcount(uint(x)) == 1
+}
+
+// Rewrites `x * 2^n` to `x << n`. Division is kept as IR_DIV with
+// an immediate operand because a signed division rounds toward zero
+// and needs a bias before shifting, which gen_x86 takes care of.
+// An exact or unsigned division has nothing to round, so it becomes
+// `x >> n`.
+// Multiplication and division by 1 are removed.
+func strength_reduce(irv *Vector) {
+	for i := range is_const {
+		is_const[i] = false
+	}
+
+	for i := 0; i < irv.len; i++ {
+		ir := irv.data[i].(*IR)
+
+		switch ir.op {
+		case IR_LABEL:
+			for i := range is_const {
+				is_const[i] = false
+			}
+			continue
+		case IR_MUL, IR_DIV:
+			if ir.is_imm || !is_const[ir.rhs] {
+				break
+			}
+			k := const_val[ir.rhs]
+			if k == 1 {
+				ir.op = IR_NOP
+				continue
+			}
+			if !is_pow2(k) {
+				break
+			}
+			ir.is_imm = true
+			if ir.op == IR_MUL {
+				ir.op = IR_SHL
+				ir.rhs = ctz(uint(k))
+			} else if ir.is_unsigned {
+				ir.op = IR_SHR
+				ir.rhs = ctz(uint(k))
+			} else if ir.is_exact {
+				ir.op = IR_SAR
+				ir.rhs = ctz(uint(k))
+			} else {
+				ir.rhs = k
+			}
+		}
+
+		// Track registers holding constants.
+		switch irinfo[ir.op].ty {
+		case IR_TY_BINARY, IR_TY_REG_REG, IR_TY_REG_IMM, IR_TY_LABEL_ADDR, IR_TY_CALL:
+			is_const[ir.lhs] = ir.op == IR_IMM
+			const_val[ir.lhs] = ir.rhs
+		case IR_TY_REG:
+			if ir.op == IR_NEG || ir.op == IR_NOT {
+				is_const[ir.lhs] = false
+			}
+		case IR_TY_MEM:
+			if ir.op == IR_LOAD || ir.op == IR_STRUCT_EQ {
+				is_const[ir.lhs] = false
+			}
+		}
+	}
+}
+
+// Removes a label that immediately follows another label.
+// Nested control flow often emits such runs, e.g. the end of an
+// inner loop followed by the end of an outer one. Jumps to the
+// removed label are redirected to the one kept.
+func merge_labels(irv *Vector) {
+	alias := make([]int, nlabel)
+	v := new_vec()
+	var prev *IR
+
+	for i := 0; i < irv.len; i++ {
+		ir := irv.data[i].(*IR)
+		if ir.op == IR_LABEL && prev != nil && prev.op == IR_LABEL {
+			alias[ir.lhs] = prev.lhs
+			prev.is_loop = prev.is_loop || ir.is_loop
+			continue
+		}
+		vec_push(v, ir)
+		prev = ir
+	}
+
+	for i := 0; i < v.len; i++ {
+		ir := v.data[i].(*IR)
+		switch ir.op {
+		case IR_JMP:
+			if alias[ir.lhs] != 0 {
+				ir.lhs = alias[ir.lhs]
+			}
+		case IR_IF, IR_UNLESS:
+			if alias[ir.rhs] != 0 {
+				ir.rhs = alias[ir.rhs]
+			}
+		case IR_BR:
+			if alias[ir.label] != 0 {
+				ir.label = alias[ir.label]
+			}
+		}
+	}
+	*irv = *v
+}
+
+// Returns the index of the instruction before i, skipping KILLs
+// and NOPs since they emit no code.
+func prev_insn(irv *Vector, i int) int {
+	for i--; i >= 0; i-- {
+		op := irv.data[i].(*IR).op
+		if op != IR_KILL && op != IR_NOP {
+			return i
+		}
+	}
+	return -1
+}
+
+func is_cmp(op int) bool {
+	return op == IR_EQ || op == IR_NE || op == IR_LT || op == IR_LE
+}
+
+// Fuses a comparison and the IF or UNLESS that tests it:
+//
+//	LT r1, r2
+//	UNLESS r1, .L1
+//	KILL r1
+//
+// becomes `BR !LT r1, r2, .L1`. A `!` in between, which is
+// `EQ r1, r3` with r3 holding 0, flips the branch instead, so
+// `if (!(a < b))` needs no 0/1 value either. The tested register
+// must die right after the branch since it no longer gets a 0/1
+// value.
+func fuse_branches(irv *Vector) {
+	for i := 0; i+1 < irv.len; i++ {
+		ir := irv.data[i].(*IR)
+		if ir.op != IR_IF && ir.op != IR_UNLESS {
+			continue
+		}
+		r := ir.lhs
+		next := irv.data[i+1].(*IR)
+		if next.op != IR_KILL || next.lhs != r {
+			continue
+		}
+
+		neg := ir.op == IR_UNLESS
+		folded := false
+		j := prev_insn(irv, i)
+		for j >= 0 {
+			d := irv.data[j].(*IR)
+			if d.op != IR_EQ || d.lhs != r {
+				break
+			}
+			k := prev_insn(irv, j)
+			if k < 0 {
+				break
+			}
+			z := irv.data[k].(*IR)
+			if z.op != IR_IMM || z.lhs != d.rhs || z.rhs != 0 {
+				break
+			}
+			d.op = IR_NOP
+			z.op = IR_NOP
+			neg = !neg
+			folded = true
+			j = prev_insn(irv, k)
+		}
+
+		if j >= 0 {
+			d := irv.data[j].(*IR)
+			if is_cmp(d.op) && d.lhs == r {
+				d.cond = d.op
+				d.op = IR_BR
+				d.is_neg = neg
+				d.label = ir.rhs
+				ir.op = IR_NOP
+				continue
+			}
+		}
+		if folded {
+			ir.op = IR_IF
+			if neg {
+				ir.op = IR_UNLESS
+			}
+		}
+	}
+}
+
+func optimize(fns *Vector) {
+	if opt_level == 0 {
+		return
+	}
+
+	reg_vn = make([]int, nreg)
+	vn_reg = make([]int, 1)
+	is_const = make([]bool, nreg)
+	const_val = make([]int, nreg)
+	const_def = make([]int, nreg)
+	const_read = make([]bool, nreg)
+	nread = make([]int, nreg)
+	for i := 0; i < fns.len; i++ {
+		fn := fns.data[i].(*Function)
+		merge_labels(fn.ir)
+		fuse_branches(fn.ir)
+		for fold_constants(fn.ir) {
+		}
+		cse(fn.ir)
+		strength_reduce(fn.ir)
+		eliminate_dead_code(fn)
+	}
+}
@@ -9,17 +9,21 @@ package main
 // Semantic errors are detected in a later pass.
 
 var (
-	pos        = 0
-	penv       *PEnv
-	tokens     *Vector
-	int_ty     = Type{ty: INT, size: 4, align: 4}
-	null_stmt  = Node{op: ND_NULL}
-	break_stmt = Node{op: ND_BREAK}
+	pos       = 0
+	penv      *PEnv
+	tokens    *Vector
+	switches  *Vector
+	labels    *Map    // label name -> token, in the current function
+	gotos     *Vector // goto tokens in the current function
+	int_ty    = Type{ty: INT, size: 4, align: 4}
+	null_stmt = Node{op: ND_NULL}
 )
 
 type PEnv struct {
 	typedefs *Map
 	tags     *Map
+	enums    *Map
+	vars     *Map // types of variables, whose names hide typedefs
 	next     *PEnv
 }
 
@@ -27,12 +31,17 @@ func new_penv(next *PEnv) *PEnv {
 	env := new(PEnv)
 	env.typedefs = new_map()
 	env.tags = new_map()
+	env.enums = new_map()
+	env.vars = new_map()
 	env.next = next
 	return env
 }
 
 func find_typedef(name string) *Type {
 	for e := penv; e != nil; e = e.next {
+		if map_get(e.vars, name) != nil {
+			return nil
+		}
 		ty := map_get(e.typedefs, name)
 		if ty != nil {
 			return ty.(*Type)
@@ -51,6 +60,21 @@ func find_tag(name string) *Type {
 	return nil
 }
 
+// Returns an enumerator constant as an ND_NUM node, or nil if
+// the name is not an enumerator or is hidden by a local variable.
+func find_enum(name string) *Node {
+	for e := penv; e != nil; e = e.next {
+		if map_get(e.vars, name) != nil {
+			return nil
+		}
+		val := map_get(e.enums, name)
+		if val != nil {
+			return new_num(val.(int))
+		}
+	}
+	return nil
+}
+
 func expect(ty int) {
 	t := tokens.data[pos].(*Token)
 	if t.ty == ty {
@@ -59,7 +83,7 @@ func expect(ty int) {
 	}
 
 	if isprint(rune(ty)) {
-		bad_token(t, format("%c expected", ty))
+		bad_token(t, format("'%c' expected", ty))
 	}
 	// assert(ty == TK_WHILE)
 	//bad_token(t, format("'while' expected", ty))
@@ -74,9 +98,22 @@ func new_prim_ty(ty, size int) *Type {
 	return ret
 }
 
-func void_tyf() *Type { return new_prim_ty(VOID, 0) }
-func char_tyf() *Type { return new_prim_ty(CHAR, 1) }
-func int_tyf() *Type  { return new_prim_ty(INT, 4) }
+// sizeof(void) is 1 as in GCC, so that arithmetic on void pointers
+// works like on char pointers.
+func void_tyf() *Type  { return new_prim_ty(VOID, 1) }
+func char_tyf() *Type  { return new_prim_ty(CHAR, 1) }
+func short_tyf() *Type { return new_prim_ty(SHORT, 2) }
+func int_tyf() *Type   { return new_prim_ty(INT, 4) }
+func long_tyf() *Type  { return new_prim_ty(LONG, 8) }
+
+// Returns the token n tokens ahead. Looking past the end of input
+// returns the TK_EOF token.
+func lookahead(n int) *Token {
+	if pos+n >= tokens.len {
+		return tokens.data[tokens.len-1].(*Token)
+	}
+	return tokens.data[pos+n].(*Token)
+}
 
 func consume(ty int) bool {
 	t := tokens.data[pos].(*Token)
@@ -93,30 +130,189 @@ func is_typename() bool {
 		ret := find_typedef(t.name)
 		return ret != nil
 	}
-	return t.ty == TK_INT || t.ty == TK_CHAR || t.ty == TK_VOID || t.ty == TK_STRUCT
+	return t.ty == TK_INT || t.ty == TK_CHAR || t.ty == TK_SHORT || t.ty == TK_LONG || t.ty == TK_UNSIGNED || t.ty == TK_SIGNED || t.ty == TK_VOID || t.ty == TK_STRUCT || t.ty == TK_UNION || t.ty == TK_ENUM || t.ty == TK_VOLATILE
 }
 
-func add_members(ty *Type, members *Vector) {
-	off := 0
+// Lays out struct members. Members of a packed struct have no
+// padding between them and the struct is byte-aligned.
+// Members are laid out in bits so that consecutive bitfields can share
+// a storage unit. A bitfield never straddles a boundary of a unit of
+// its declared type; it starts a new unit instead.
+func add_members(ty *Type, members *Vector, packed bool) {
+	bits := 0
+	ty.align = 1
 	for i := 0; i < members.len; i++ {
 		node := members.data[i].(*Node)
 		//assert(node.op == ND_VARDEF)
 
 		t := node.ty
-		off = roundup(off, t.align)
-		t.offset = off
-		off += t.size
+		if ty.is_union {
+			// All members of a union share the same storage.
+			t.offset = 0
+			t.bit_offset = 0
+			if bits < t.size*8 {
+				bits = t.size * 8
+			}
+		} else if t.bit_width > 0 {
+			unit := t.size * 8
+			if bits/unit != (bits+t.bit_width-1)/unit {
+				bits = roundup(bits, unit)
+			}
+			t.offset = bits / unit * t.size
+			t.bit_offset = bits % unit
+			bits += t.bit_width
+		} else {
+			off := roundup(bits, 8) / 8
+			if !packed {
+				off = roundup(off, t.align)
+			}
+			t.offset = off
+			bits = (off + t.size) * 8
+		}
 
-		if ty.align < node.ty.align {
+		if !packed && ty.align < node.ty.align {
 			ty.align = node.ty.align
 		}
 	}
 
 	ty.members = members
-	ty.size = roundup(off, ty.align)
+	ty.size = roundup(roundup(bits, 8)/8, ty.align)
+}
+
+func find_member(ty *Type, name string) *Node {
+	if ty.ty != STRUCT || ty.members == nil {
+		return nil
+	}
+	for i := 0; i < ty.members.len; i++ {
+		m := ty.members.data[i].(*Node)
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns a copy of a given type with an alignment raised by
+// an aligned attribute. The alignment is never decreased.
+func align_by_attr(ty *Type, attr *Attr) *Type {
+	if attr.aligned <= ty.align {
+		return ty
+	}
+	ty2 := *ty
+	ty2.align = attr.aligned
+	return &ty2
+}
+
+// Reads GCC-style attributes such as `__attribute__((packed))`.
+// Unknown attributes are ignored with a warning.
+func attributes(attr *Attr) {
+	for {
+		t := tokens.data[pos].(*Token)
+		if t.ty != TK_IDENT || t.name != "__attribute__" {
+			return
+		}
+		pos++
+		expect('(')
+		expect('(')
+
+		for !consume(')') {
+			t := tokens.data[pos].(*Token)
+			name := ident()
+			if name == "packed" || name == "__packed__" {
+				attr.packed = true
+			} else if name == "aligned" || name == "__aligned__" {
+				// Without an argument, the maximum useful alignment is used.
+				attr.aligned = 16
+				if consume('(') {
+					attr.aligned = const_expr()
+					expect(')')
+				}
+				if popcount(uint(attr.aligned)) != 1 {
+					bad_token(t, "requested alignment is not a power of 2")
+				}
+			} else {
+				warn_token(t, format("unknown attribute: %s", name))
+				// Skip arguments of the unknown attribute.
+				if consume('(') {
+					for depth := 1; depth > 0; pos++ {
+						ty := tokens.data[pos].(*Token).ty
+						if ty == '(' {
+							depth++
+						} else if ty == ')' {
+							depth--
+						} else if ty == TK_EOF {
+							bad_token(t, "unclosed attribute")
+						}
+					}
+				}
+			}
+			if !consume(',') {
+				expect(')')
+				break
+			}
+		}
+		expect(')')
+	}
 }
 
 func decl_specifiers() *Type {
+	is_volatile := consume(TK_VOLATILE)
+	t := tokens.data[pos].(*Token)
+	ty := type_specifier()
+	if ty == nil {
+		bad_token(t, "typename expected")
+	}
+	if consume(TK_VOLATILE) || is_volatile {
+		ty = volatile_of(ty)
+	}
+	return ty
+}
+
+// Returns a volatile-qualified copy of a given type.
+func volatile_of(ty *Type) *Type {
+	ty2 := *ty
+	ty2.is_volatile = true
+	return &ty2
+}
+
+func is_int_specifier(ty int) bool {
+	return ty == TK_INT || ty == TK_CHAR || ty == TK_SHORT || ty == TK_LONG || ty == TK_UNSIGNED || ty == TK_SIGNED
+}
+
+// Reads integer type specifiers, which may come in any order as in
+// `long unsigned int`. `signed` or `unsigned` alone means int, and
+// `long long` has the same representation as `long`.
+func int_specifiers() *Type {
+	t := tokens.data[pos].(*Token)
+	n := map[int]int{}
+	for is_int_specifier(tokens.data[pos].(*Token).ty) {
+		n[tokens.data[pos].(*Token).ty]++
+		pos++
+	}
+
+	var ty *Type
+	switch {
+	case n[TK_SIGNED]+n[TK_UNSIGNED] > 1:
+		bad_token(t, "invalid combination of type specifiers")
+	case n[TK_CHAR] == 1 && n[TK_SHORT]+n[TK_LONG]+n[TK_INT] == 0:
+		ty = char_tyf()
+	case n[TK_SHORT] == 1 && n[TK_CHAR]+n[TK_LONG] == 0 && n[TK_INT] <= 1:
+		ty = short_tyf()
+	case n[TK_LONG] == 1 || n[TK_LONG] == 2:
+		if n[TK_CHAR]+n[TK_SHORT] != 0 || n[TK_INT] > 1 {
+			bad_token(t, "invalid combination of type specifiers")
+		}
+		ty = long_tyf()
+	case n[TK_CHAR]+n[TK_SHORT]+n[TK_LONG] == 0 && n[TK_INT] <= 1:
+		ty = int_tyf()
+	default:
+		bad_token(t, "invalid combination of type specifiers")
+	}
+	ty.is_unsigned = n[TK_UNSIGNED] == 1
+	return ty
+}
+
+func type_specifier() *Type {
 	t := tokens.data[pos].(*Token)
 	pos++
 
@@ -128,19 +324,20 @@ func decl_specifiers() *Type {
 		return ty
 	}
 
-	if t.ty == TK_INT {
-		return int_tyf()
-	}
-
-	if t.ty == TK_CHAR {
-		return char_tyf()
+	if is_int_specifier(t.ty) {
+		pos--
+		return int_specifiers()
 	}
 
 	if t.ty == TK_VOID {
 		return void_tyf()
 	}
 
-	if t.ty == TK_STRUCT {
+	if t.ty == TK_STRUCT || t.ty == TK_UNION {
+		is_union := t.ty == TK_UNION
+		attr := new(Attr)
+		attributes(attr)
+
 		var tag string
 		t := tokens.data[pos].(*Token)
 		if t.ty == TK_IDENT {
@@ -152,8 +349,12 @@ func decl_specifiers() *Type {
 		if consume('{') {
 			members = new_vec()
 			for !consume('}') {
-				vec_push(members, declaration())
+				node := struct_member()
+				if node.op != ND_NULL {
+					vec_push(members, node)
+				}
 			}
+			attributes(attr)
 		}
 
 		if tag == "" && members == nil {
@@ -168,10 +369,11 @@ func decl_specifiers() *Type {
 		if ty == nil {
 			ty = new(Type)
 			ty.ty = STRUCT
+			ty.is_union = is_union
 		}
 
 		if members != nil {
-			add_members(ty, members)
+			add_members(ty, members, attr.packed)
 			if tag != "" {
 				map_put(penv.tags, tag, ty)
 			}
@@ -179,10 +381,53 @@ func decl_specifiers() *Type {
 		return ty
 	}
 
+	if t.ty == TK_ENUM {
+		return enum_specifier()
+	}
+
 	bad_token(t, "typename expected")
 	return nil
 }
 
+// Enumerators are integer constants. Each one without an explicit
+// value gets the previous value plus one, starting from zero.
+func enum_specifier() *Type {
+	t := tokens.data[pos].(*Token)
+	tag := ""
+	if t.ty == TK_IDENT {
+		pos++
+		tag = t.name
+	}
+
+	if !consume('{') {
+		if tag == "" {
+			bad_token(t, "bad enum definition")
+		}
+		return int_tyf()
+	}
+
+	val := 0
+	for !consume('}') {
+		name := ident()
+		if consume('=') {
+			val = const_expr()
+		}
+		map_put(penv.enums, name, val)
+		val++
+
+		if !consume(',') {
+			expect('}')
+			break
+		}
+	}
+
+	ty := int_tyf()
+	if tag != "" {
+		map_put(penv.tags, tag, ty)
+	}
+	return ty
+}
+
 func new_binop(op int, lhs, rhs *Node) *Node {
 	node := new(Node)
 	node.op = op
@@ -232,9 +477,14 @@ func primary() *Node {
 		return node
 	}
 
+	// A literal too large for int is a long.
 	node := new(Node)
 	if t.ty == TK_NUM {
-		return new_num(t.val)
+		node := new_num(t.val)
+		if t.val != int(int32(t.val)) {
+			node.ty = long_tyf()
+		}
+		return node
 	}
 
 	if t.ty == TK_STR {
@@ -249,11 +499,79 @@ func primary() *Node {
 		node.name = t.name
 
 		if !consume('(') {
+			if e := find_enum(t.name); e != nil {
+				return e
+			}
 			node.op = ND_IDENT
 			return node
 		}
 
+		if t.name == "__builtin_trap" || t.name == "__builtin_unreachable" {
+			expect(')')
+			if t.name == "__builtin_trap" {
+				node.op = ND_TRAP
+			} else {
+				node.op = ND_UNREACHABLE
+			}
+			return node
+		}
+
+		if t.name == "__builtin_offsetof" {
+			ty := type_name()
+			expect(',')
+			off := 0
+			for {
+				t := tokens.data[pos].(*Token)
+				m := find_member(ty, ident())
+				if m == nil {
+					bad_token(t, "member missing")
+				}
+				off += m.ty.offset
+				ty = m.ty
+				if !consume('.') {
+					break
+				}
+			}
+			expect(')')
+			// The result is size_t, i.e. unsigned long.
+			node := new_num(off)
+			node.ty = long_tyf()
+			node.ty.is_unsigned = true
+			return node
+		}
+
+		if t.name == "__builtin_struct_eq" {
+			node.op = ND_STRUCT_EQ
+			node.lhs = assign()
+			expect(',')
+			node.rhs = assign()
+			expect(')')
+			return node
+		}
+
+		if t.name == "__builtin_va_start" {
+			node.op = ND_VA_START
+			node.expr = assign()
+			// The last named parameter is accepted for compatibility
+			// but not needed to locate the variadic arguments.
+			if consume(',') {
+				assign()
+			}
+			expect(')')
+			return node
+		}
+
+		if t.name == "__builtin_va_arg" {
+			node.op = ND_VA_ARG
+			node.expr = assign()
+			expect(',')
+			node.ty = type_name()
+			expect(')')
+			return node
+		}
+
 		node.op = ND_CALL
+		node.token = t
 		node.args = new_vec()
 		if consume(')') {
 			return node
@@ -275,13 +593,16 @@ func postfix() *Node {
 	lhs := primary()
 
 	for {
+		t := tokens.data[pos].(*Token)
 		if consume(TK_INC) {
 			lhs = new_expr(ND_POST_INC, lhs)
+			lhs.token = t
 			continue
 		}
 
 		if consume(TK_DEC) {
 			lhs = new_expr(ND_POST_DEC, lhs)
+			lhs.token = t
 			continue
 		}
 
@@ -304,18 +625,22 @@ func postfix() *Node {
 		}
 		return lhs
 	}
-	return nil
 }
 
 func unary() *Node {
 	if consume('-') {
 		return new_expr(ND_NEG, unary())
 	}
+	t := tokens.data[pos].(*Token)
 	if consume('*') {
-		return new_expr(ND_DEREF, unary())
+		node := new_expr(ND_DEREF, unary())
+		node.token = t
+		return node
 	}
 	if consume('&') {
-		return new_expr(ND_ADDR, unary())
+		node := new_expr(ND_ADDR, unary())
+		node.token = t
+		return node
 	}
 	if consume('!') {
 		return new_expr('!', unary())
@@ -323,18 +648,40 @@ func unary() *Node {
 	if consume('~') {
 		return new_expr('~', unary())
 	}
+
+	// A parenthesized type name is a cast. An identifier in
+	// parentheses is a typedef name only if no variable hides it.
+	if ty := paren_type_name(); ty != nil {
+		node := new_expr(ND_CAST, unary())
+		node.ty = ty
+		node.token = t
+		return node
+	}
+
 	if consume(TK_SIZEOF) {
-		return new_expr(ND_SIZEOF, unary())
+		if ty := paren_type_name(); ty != nil {
+			return new_num(ty.size)
+		}
+		node := new_expr(ND_SIZEOF, unary())
+		node.token = t
+		return node
 	}
 	if consume(TK_ALIGNOF) {
+		if ty := paren_type_name(); ty != nil {
+			return new_num(ty.align)
+		}
 		return new_expr(ND_ALIGNOF, unary())
 	}
 
 	if consume(TK_INC) {
-		return new_binop(ND_ADD_EQ, unary(), new_num(1))
+		node := new_binop(ND_ADD_EQ, unary(), new_num(1))
+		node.token = t
+		return node
 	}
 	if consume(TK_DEC) {
-		return new_binop(ND_SUB_EQ, unary(), new_num(1))
+		node := new_binop(ND_SUB_EQ, unary(), new_num(1))
+		node.token = t
+		return node
 	}
 
 	return postfix()
@@ -353,7 +700,6 @@ func mul() *Node {
 			return lhs
 		}
 	}
-	return lhs
 }
 
 func read_array(ty *Type) *Type {
@@ -366,11 +712,11 @@ func read_array(ty *Type) *Type {
 		}
 
 		t := tokens.data[pos].(*Token)
-		l := expr()
-		if l.op != ND_NUM {
-			bad_token(t, "number expected")
+		l := const_expr()
+		if l <= 0 {
+			bad_token(t, "array size must be positive")
 		}
-		vec_push(v, l.val)
+		vec_push(v, l)
 		expect(']')
 	}
 	for i := v.len - 1; i >= 0; i-- {
@@ -391,7 +737,6 @@ func parse_add() *Node {
 			return lhs
 		}
 	}
-	return lhs
 }
 
 func shift() *Node {
@@ -405,7 +750,6 @@ func shift() *Node {
 			return lhs
 		}
 	}
-	return lhs
 }
 
 func relational() *Node {
@@ -428,6 +772,7 @@ func relational() *Node {
 func equality() *Node {
 	lhs := relational()
 	for {
+		t := tokens.data[pos].(*Token)
 		if consume(TK_EQ) {
 			lhs = new_binop(ND_EQ, lhs, relational())
 		} else if consume(TK_NE) {
@@ -435,6 +780,7 @@ func equality() *Node {
 		} else {
 			return lhs
 		}
+		lhs.token = t
 	}
 }
 
@@ -487,12 +833,128 @@ func conditional() *Node {
 	node := new(Node)
 	node.op = '?'
 	node.cond = cond
-	node.then = expr()
-	expect(':')
+
+	// `x ?: y` (GNU extension) is `x ? x : y` except that x is
+	// evaluated only once. then is left nil for it.
+	if !consume(':') {
+		node.then = expr()
+		expect(':')
+	}
 	node.els = conditional()
 	return node
 }
 
+// Evaluates a given node as an integer constant expression.
+// t is used to report an error if the node is not a constant.
+func eval(node *Node, t *Token) int {
+	switch node.op {
+	case ND_NUM:
+		return node.val
+	case '+':
+		return eval(node.lhs, t) + eval(node.rhs, t)
+	case '-':
+		return eval(node.lhs, t) - eval(node.rhs, t)
+	case '*':
+		return eval(node.lhs, t) * eval(node.rhs, t)
+	case '/', '%':
+		{
+			lhs, rhs := eval(node.lhs, t), eval(node.rhs, t)
+			if rhs == 0 {
+				bad_token(t, "division by zero in constant expression")
+			}
+			if node.op == '/' {
+				return lhs / rhs
+			}
+			return lhs % rhs
+		}
+	case '<':
+		return bool2int(eval(node.lhs, t) < eval(node.rhs, t))
+	case ND_LE:
+		return bool2int(eval(node.lhs, t) <= eval(node.rhs, t))
+	case ND_EQ:
+		return bool2int(eval(node.lhs, t) == eval(node.rhs, t))
+	case ND_NE:
+		return bool2int(eval(node.lhs, t) != eval(node.rhs, t))
+	case '&':
+		return eval(node.lhs, t) & eval(node.rhs, t)
+	case '|':
+		return eval(node.lhs, t) | eval(node.rhs, t)
+	case '^':
+		return eval(node.lhs, t) ^ eval(node.rhs, t)
+	case ND_SHL:
+		return eval(node.lhs, t) << uint(eval(node.rhs, t))
+	case ND_SHR:
+		return eval(node.lhs, t) >> uint(eval(node.rhs, t))
+	case ND_LOGAND:
+		return bool2int(eval(node.lhs, t) != 0 && eval(node.rhs, t) != 0)
+	case ND_LOGOR:
+		return bool2int(eval(node.lhs, t) != 0 || eval(node.rhs, t) != 0)
+	case ND_NEG:
+		return -eval(node.expr, t)
+	case '!':
+		return bool2int(eval(node.expr, t) == 0)
+	case '~':
+		return ^eval(node.expr, t)
+	case ND_CAST:
+		{
+			val := eval(node.expr, t)
+			if is_integer(node.ty) && node.ty.size < 8 {
+				n := uint(64 - node.ty.size*8)
+				if node.ty.is_unsigned {
+					return int(uint(val) << n >> n)
+				}
+				return val << n >> n
+			}
+			return val
+		}
+	case '?':
+		if c := eval(node.cond, t); c != 0 {
+			if node.then == nil {
+				return c
+			}
+			return eval(node.then, t)
+		}
+		return eval(node.els, t)
+	case ND_IDENT:
+		bad_token(t, format("variable '%s' in constant expression", node.name))
+	case ND_CALL:
+		bad_token(t, format("function call '%s()' in constant expression", node.name))
+	case ND_SIZEOF:
+		// The operand is not evaluated, so side effects in it are
+		// most likely a mistake.
+		if has_side_effects(node.expr) {
+			bad_token(t, "sizeof of an expression with side effects in constant expression")
+		}
+		return const_operand_type(node.expr).size
+	case ND_ALIGNOF:
+		bad_token(t, "_Alignof of an expression in constant expression")
+	}
+	bad_token(t, "constant expression expected")
+	return 0
+}
+
+// Returns true if evaluating a given expression may assign
+// a variable or call a function.
+func has_side_effects(node *Node) bool {
+	if node == nil {
+		return false
+	}
+	switch node.op {
+	case '=', ND_MUL_EQ, ND_DIV_EQ, ND_MOD_EQ, ND_ADD_EQ, ND_SUB_EQ,
+		ND_SHL_EQ, ND_SHR_EQ, ND_BITAND_EQ, ND_XOR_EQ, ND_BITOR_EQ,
+		ND_POST_INC, ND_POST_DEC, ND_CALL, ND_STMT_EXPR:
+		return true
+	}
+	return has_side_effects(node.lhs) || has_side_effects(node.rhs) ||
+		has_side_effects(node.expr) || has_side_effects(node.cond) ||
+		has_side_effects(node.then) || has_side_effects(node.els)
+}
+
+func const_expr() int {
+	t := tokens.data[pos].(*Token)
+	return eval(conditional(), t)
+}
+
 func assignment_op() int {
 	if consume('=') {
 		return '='
@@ -530,11 +992,17 @@ func assignment_op() int {
 	return 0
 }
 
+// A compound assignment such as `a += b` is not rewritten to
+// `a = a + b`. It is kept as its own node so that gen_ir evaluates
+// the address of `a` only once, which matters for `a[i++] += b`.
 func assign() *Node {
 	lhs := conditional()
+	t := tokens.data[pos].(*Token)
 	op := assignment_op()
 	if op != 0 {
-		return new_binop(op, lhs, assign())
+		node := new_binop(op, lhs, assign())
+		node.token = t
+		return node
 	}
 	return lhs
 }
@@ -564,30 +1032,435 @@ func direct_decl(ty *Type) *Node {
 		bad_token(t, "bad direct-declarator")
 	}
 
-	// Read the second half of type name (e.g. `[3][5]`).
-	*placeholder = *read_array(ty)
+	// Read the second half of type name (e.g. `[3][5]` or `(int, int)`).
+	if consume('(') {
+		*placeholder = *read_func_params(ty)
+	} else {
+		*placeholder = *read_array(ty)
+	}
+
+	attr := new(Attr)
+	attributes(attr)
+	*placeholder = *align_by_attr(placeholder, attr)
 
 	// Read an initializer.
+	t = tokens.data[pos].(*Token)
 	if consume('=') {
-		node.init = assign()
+		node.token = t
+		initializer(node)
 	}
 	return node
 }
 
+// A path from a variable to one of its elements, such as `x.b[1]`.
+type Designator struct {
+	next *Designator
+	idx  int
+	name string // struct member name
+}
+
+// Returns an lvalue expression denoting a designated element.
+// A new tree is built for each element because sema rewrites
+// the nodes it walks.
+func desg_expr(name string, desg *Designator) *Node {
+	if desg == nil {
+		node := new(Node)
+		node.op = ND_IDENT
+		node.name = name
+		return node
+	}
+
+	base := desg_expr(name, desg.next)
+	if desg.name != "" {
+		node := new_expr(ND_DOT, base)
+		node.name = desg.name
+		return node
+	}
+	return new_expr(ND_DEREF, new_binop('+', base, new_num(desg.idx)))
+}
+
+func is_aggregate(ty *Type) bool {
+	return ty.ty == ARY || ty.ty == STRUCT
+}
+
+func initializer(node *Node) {
+	ty := node.ty
+
+	// The length of an array such as `int a[] = {1, 2}` is given
+	// by its initializer.
+	if ty.ty == ARY && ty.len < 0 {
+		ty = ary_of(ty.ary_of, init_len(ty.ary_of))
+		node.ty = ty
+	}
+
+	if is_string_init(ty) {
+		node.inits = new_vec()
+		string_init(node.name, ty, nil, node.inits)
+		return
+	}
+	if is_aggregate(ty) {
+		node.inits = new_vec()
+		t := tokens.data[pos].(*Token)
+		if !consume('{') {
+			bad_token(t, "invalid initializer")
+		}
+		aggregate_init(node.name, ty, nil, node.inits, true)
+		return
+	}
+
+	// A scalar initializer may be enclosed in braces.
+	if consume('{') {
+		node.init = assign()
+		consume(',')
+		expect('}')
+		return
+	}
+	node.init = assign()
+}
+
+// Returns the number of scalars in a type, which is the number of
+// initializers it takes if inner braces are omitted.
+func num_scalars(ty *Type) int {
+	if !is_aggregate(ty) {
+		return 1
+	}
+	n := 0
+	for i := 0; i < num_elements(ty); i++ {
+		ety, _ := element(ty, nil, i)
+		n += num_scalars(ety)
+	}
+	return n
+}
+
+// Returns the number of elements an initializer gives to an array
+// of unknown length. Tokens are not consumed.
+func init_len(elem *Type) int {
+	t := tokens.data[pos].(*Token)
+	if t.ty == TK_STR && elem.ty == CHAR {
+		return t.len + 1
+	}
+	if t.ty != '{' {
+		bad_token(t, "invalid initializer")
+	}
+
+	start := pos
+	pos++
+	elided := is_aggregate(elem) && tokens.data[pos].(*Token).ty != '{' && !is_string_init(elem)
+	n := skip_elements()
+	pos = start
+
+	if elided {
+		k := num_scalars(elem)
+		return (n + k - 1) / k
+	}
+	return n
+}
+
+// Returns the type and designator of the i-th element of an aggregate.
+func element(ty *Type, desg *Designator, i int) (*Type, *Designator) {
+	d := new(Designator)
+	d.next = desg
+	if ty.ty == ARY {
+		d.idx = i
+		return ty.ary_of, d
+	}
+	m := ty.members.data[i].(*Node)
+	d.name = m.name
+	return m.ty, d
+}
+
+func num_elements(ty *Type) int {
+	if ty.ty == ARY {
+		return ty.len
+	}
+	if ty.members == nil {
+		return 0
+	}
+	// Only the first member of a union is initialized.
+	if ty.is_union && ty.members.len > 0 {
+		return 1
+	}
+	return ty.members.len
+}
+
+func is_string_init(ty *Type) bool {
+	return ty.ty == ARY && ty.ary_of.ty == CHAR && tokens.data[pos].(*Token).ty == TK_STR
+}
+
+// Initializes a char array with a string literal. The terminating
+// NUL is stored only if there is room for it, so `char s[3] = "abc"`
+// is valid and has no NUL. The rest of the array is zero-filled.
+func string_init(name string, ty *Type, desg *Designator, inits *Vector) {
+	t := tokens.data[pos].(*Token)
+	pos++
+	if t.len > ty.len {
+		bad_token(t, "initializer-string for char array is too long")
+	}
+
+	for i := 0; i < ty.len; i++ {
+		c := 0
+		if i < t.len {
+			c = int(t.str[i])
+		}
+		_, d := element(ty, desg, i)
+		vec_push(inits, new_binop('=', desg_expr(name, d), new_num(c)))
+	}
+}
+
+// Reads an initializer of an element of an aggregate.
+func elem_init(name string, ty *Type, desg *Designator, inits *Vector) {
+	if is_string_init(ty) {
+		string_init(name, ty, desg, inits)
+		return
+	}
+	if is_aggregate(ty) {
+		// Inner braces may be omitted, in which case the elements
+		// are taken from the enclosing list.
+		aggregate_init(name, ty, desg, inits, consume('{'))
+		return
+	}
+
+	t := tokens.data[pos].(*Token)
+	if t.ty == '{' {
+		bad_token(t, "braces around scalar initializer")
+	}
+	vec_push(inits, new_binop('=', desg_expr(name, desg), assign()))
+}
+
+// Reads the elements of an aggregate. If the list is braced, the
+// opening brace has already been consumed. Elements without an
+// initializer are set to zero.
+func aggregate_init(name string, ty *Type, desg *Designator, inits *Vector, braced bool) {
+	n := num_elements(ty)
+	i := 0
+	for ; i < n; i++ {
+		if i > 0 {
+			// A comma followed by '}' is a trailing comma.
+			if lookahead(0).ty != ',' || lookahead(1).ty == '}' {
+				break
+			}
+			pos++
+		} else if braced && tokens.data[pos].(*Token).ty == '}' {
+			break
+		}
+
+		ety, d := element(ty, desg, i)
+		elem_init(name, ety, d, inits)
+	}
+
+	full := i == n
+	for ; i < n; i++ {
+		ety, d := element(ty, desg, i)
+		zero_init(name, ety, d, inits)
+	}
+
+	if braced {
+		consume(',')
+		t := tokens.data[pos].(*Token)
+		if consume('}') {
+			return
+		}
+		if t.ty == TK_EOF {
+			expect('}')
+		}
+		if !full {
+			bad_token(t, "excess elements in initializer")
+		}
+		extra := skip_elements()
+		bad_token(t, format("excess elements in initializer (%d elements for %d)", n+extra, n))
+	}
+}
+
+// Skips the rest of an initializer list and returns the number
+// of elements in it.
+func skip_elements() int {
+	n := 0
+	for tokens.data[pos].(*Token).ty != '}' {
+		if consume('{') {
+			skip_elements()
+			expect('}')
+		} else {
+			assign()
+		}
+		n++
+		if !consume(',') {
+			break
+		}
+	}
+	return n
+}
+
+func zero_init(name string, ty *Type, desg *Designator, inits *Vector) {
+	if !is_aggregate(ty) {
+		vec_push(inits, new_binop('=', desg_expr(name, desg), new_num(0)))
+		return
+	}
+	for i := 0; i < num_elements(ty); i++ {
+		ety, d := element(ty, desg, i)
+		zero_init(name, ety, d, inits)
+	}
+}
+
+// Reads a parameter list of a function type such as `int (*fp)(int, char *)`.
+// Parameter names are optional and parameter types are discarded.
+func read_func_params(returning *Type) *Type {
+	ty := func_of(returning)
+	if consume(')') {
+		return ty
+	}
+
+	t := lookahead(0)
+	if t.ty == TK_EOF {
+		expect(')')
+	}
+	if t.ty == TK_VOID && lookahead(1).ty == ')' {
+		pos += 2
+		ty.params = new_vec()
+		return ty
+	}
+
+	ty.params = new_vec()
+	for {
+		if consume(TK_ELLIPSIS) {
+			ty.is_variadic = true
+			break
+		}
+		pty := decl_specifiers()
+		for consume('*') {
+			pty = ptr_to(pty)
+		}
+		t := tokens.data[pos].(*Token)
+		if t.ty != ',' && t.ty != ')' {
+			pty = direct_decl(pty).ty
+		}
+		if pty.ty == ARY {
+			pty = ptr_to(pty.ary_of)
+		}
+		vec_push(ty.params, pty)
+		if !consume(',') {
+			break
+		}
+	}
+	expect(')')
+	return ty
+}
+
 func declarator(ty *Type) *Node {
 	for consume('*') {
 		ty = ptr_to(ty)
+		if consume(TK_VOLATILE) {
+			ty = volatile_of(ty)
+		}
 	}
 	return direct_decl(ty)
 }
 
 func declaration() *Node {
 	ty := decl_specifiers()
+
+	// A declaration without a declarator, such as `enum { A, B };`,
+	// only defines a tag or enumerators.
+	if consume(';') {
+		return &null_stmt
+	}
+
+	// Declarators share the type specifier, but pointers and
+	// arrays apply to each one, as in `int a, *p, c[3];`.
+	node := declarator(ty)
+	if !consume(',') {
+		expect(';')
+		return node
+	}
+
+	list := new(Node)
+	list.op = ND_DECL_LIST
+	list.stmts = new_vec()
+	vec_push(list.stmts, node)
+	for {
+		vec_push(list.stmts, declarator(ty))
+		if !consume(',') {
+			break
+		}
+	}
+	expect(';')
+	return list
+}
+
+// Returns the declarators of a declaration.
+func declarators(node *Node) *Vector {
+	if node.op == ND_DECL_LIST {
+		return node.stmts
+	}
+	v := new_vec()
+	if node.op == ND_VARDEF {
+		vec_push(v, node)
+	}
+	return v
+}
+
+// Reads a declaration of local variables. From here to the end
+// of the block, the names refer to the variables even if an outer
+// scope has typedefs of the same names.
+func var_declaration() *Node {
+	node := declaration()
+	v := declarators(node)
+	for i := 0; i < v.len; i++ {
+		node := v.data[i].(*Node)
+		map_put(penv.vars, node.name, node.ty)
+	}
+	return node
+}
+
+// A struct member is a declaration optionally followed by
+// a bitfield width such as `int x : 3;`.
+func struct_member() *Node {
+	ty := decl_specifiers()
+	if consume(';') {
+		return &null_stmt
+	}
+
 	node := declarator(ty)
+	if consume(':') {
+		t := tokens.data[pos].(*Token)
+		width := const_expr()
+		if !is_integer(node.ty) {
+			bad_token(t, "bit-field has non-integer type")
+		}
+		if width <= 0 || width > node.ty.size*8 {
+			bad_token(t, "invalid bit-field width")
+		}
+		node.ty.bit_width = width
+	}
 	expect(';')
 	return node
 }
 
+func type_name() *Type {
+	ty := decl_specifiers()
+	for consume('*') {
+		ty = ptr_to(ty)
+	}
+	return read_array(ty)
+}
+
+// Reads a type name enclosed in parentheses such as `(int[3])` if
+// exists. Otherwise, returns nil without consuming any tokens.
+func paren_type_name() *Type {
+	t := tokens.data[pos].(*Token)
+	if t.ty != '(' {
+		return nil
+	}
+
+	pos++
+	if !is_typename() {
+		pos--
+		return nil
+	}
+	ty := type_name()
+	expect(')')
+	return ty
+}
+
 func param_declaration() *Node {
 	ty := decl_specifiers()
 	node := declarator(ty)
@@ -597,6 +1470,40 @@ func param_declaration() *Node {
 	return node
 }
 
+// Returns true if tokens from start to end (exclusive) are enclosed
+// in a pair of parentheses as a whole.
+func is_paren_enclosed(start, end int) bool {
+	if tokens.data[start].(*Token).ty != '(' {
+		return false
+	}
+
+	depth := 0
+	for i := start; i < end; i++ {
+		t := tokens.data[i].(*Token)
+		if t.ty == '(' {
+			depth++
+		} else if t.ty == ')' {
+			depth--
+			if depth == 0 {
+				return i == end-1
+			}
+		}
+	}
+	return false
+}
+
+// Reads a controlling expression of if, while, do-while or for.
+// An assignment used as a truth value is likely a typo of `==`,
+// so warn it unless it is explicitly enclosed in parentheses.
+func cond_expr() *Node {
+	start := pos
+	node := expr()
+	if node.op == '=' && !is_paren_enclosed(start, pos) {
+		warn_token(tokens.data[start].(*Token), "suggest parentheses around assignment used as truth value")
+	}
+	return node
+}
+
 func expr_stmt() *Node {
 	node := new_expr(ND_EXPR_STMT, expr())
 	expect(';')
@@ -609,15 +1516,20 @@ func stmt() *Node {
 	pos++
 
 	switch t.ty {
+	case TK_ASSERT:
+		static_assert()
+		return &null_stmt
 	case TK_TYPEDEF:
-		node := declaration()
-		// assert(node.name)
-		map_put(penv.typedefs, node.name, node.ty)
+		v := declarators(declaration())
+		for i := 0; i < v.len; i++ {
+			node := v.data[i].(*Node)
+			map_put(penv.typedefs, node.name, node.ty)
+		}
 		return &null_stmt
 	case TK_IF:
 		node.op = ND_IF
 		expect('(')
-		node.cond = expr()
+		node.cond = cond_expr()
 		expect(')')
 
 		node.then = stmt()
@@ -630,8 +1542,9 @@ func stmt() *Node {
 		node.op = ND_FOR
 		expect('(')
 
+		penv = new_penv(penv)
 		if is_typename() {
-			node.init = declaration()
+			node.init = var_declaration()
 		} else if consume(';') {
 			node.init = &null_stmt
 		} else {
@@ -639,7 +1552,7 @@ func stmt() *Node {
 		}
 
 		if !consume(';') {
-			node.cond = expr()
+			node.cond = cond_expr()
 			expect(';')
 		}
 
@@ -649,13 +1562,14 @@ func stmt() *Node {
 		}
 
 		node.body = stmt()
+		penv = penv.next
 		return node
 	case TK_WHILE:
 		node.op = ND_FOR
 		node.init = &null_stmt
 		node.inc = &null_stmt
 		expect('(')
-		node.cond = expr()
+		node.cond = cond_expr()
 		expect(')')
 		node.body = stmt()
 		return node
@@ -664,34 +1578,102 @@ func stmt() *Node {
 		node.body = stmt()
 		expect(TK_WHILE)
 		expect('(')
-		node.cond = expr()
+		node.cond = cond_expr()
 		expect(')')
 		expect(';')
 		return node
+	case TK_SWITCH:
+		node.op = ND_SWITCH
+		node.cases = new_vec()
+		expect('(')
+		node.cond = expr()
+		expect(')')
+
+		vec_push(switches, node)
+		node.body = stmt()
+		vec_pop(switches)
+		return node
+	case TK_CASE:
+		{
+			if switches.len == 0 {
+				bad_token(t, "stray case")
+			}
+			node.op = ND_CASE
+			node.val = const_expr()
+			expect(':')
+
+			sw := vec_last(switches).(*Node)
+			for i := 0; i < sw.cases.len; i++ {
+				if sw.cases.data[i].(*Node).val == node.val {
+					bad_token(t, format("duplicate case value: %d", node.val))
+				}
+			}
+			vec_push(sw.cases, node)
+			node.body = stmt()
+			return node
+		}
+	case TK_DEFAULT:
+		{
+			if switches.len == 0 {
+				bad_token(t, "stray default")
+			}
+			expect(':')
+
+			node.op = ND_DEFAULT
+			node.body = stmt()
+			sw := vec_last(switches).(*Node)
+			if sw.default_case != nil {
+				bad_token(t, "multiple default labels in one switch")
+			}
+			sw.default_case = node
+			return node
+		}
 	case TK_BREAK:
-		return &break_stmt
+		node.op = ND_BREAK
+		node.token = t
+		return node
+	case TK_CONTINUE:
+		node.op = ND_CONTINUE
+		node.token = t
+		return node
+	case TK_GOTO:
+		node.op = ND_GOTO
+		vec_push(gotos, tokens.data[pos])
+		node.name = ident()
+		expect(';')
+		return node
 	case TK_RETURN:
 		node.op = ND_RETURN
+		node.token = t
+		if consume(';') {
+			return node
+		}
 		node.expr = expr()
 		expect(';')
 		return node
 	case '{':
-		node.op = ND_COMP_STMT
-		node.stmts = new_vec()
-		for !consume('}') {
-			vec_push(node.stmts, stmt())
-		}
-		return node
+		return compound_stmt()
 	case ';':
 		return &null_stmt
 	default:
+		if t.ty == TK_IDENT && tokens.data[pos].(*Token).ty == ':' {
+			pos++
+			if map_get(labels, t.name) != nil {
+				bad_token(t, format("duplicate label: %s", t.name))
+			}
+			map_put(labels, t.name, t)
+			node.op = ND_LABEL
+			node.name = t.name
+			node.body = stmt()
+			return node
+		}
+
 		pos--
 		if is_typename() {
-			return declaration()
+			return var_declaration()
 		}
 		return expr_stmt()
 	}
-	return nil
 }
 
 func compound_stmt() *Node {
@@ -708,75 +1690,153 @@ func compound_stmt() *Node {
 	return node
 }
 
-func toplevel() *Node {
+// Returns true if the following tokens are `*`s, an identifier
+// and `(`, which start a function declaration or definition.
+func is_funcdef() bool {
+	i := pos
+	for tokens.data[i].(*Token).ty == '*' {
+		i++
+	}
+	return tokens.data[i].(*Token).ty == TK_IDENT &&
+		tokens.data[i+1].(*Token).ty == '('
+}
+
+// Reads the rest of `_Static_assert(expr, "message");`.
+// It produces no code.
+func static_assert() {
+	expect('(')
+	t := tokens.data[pos].(*Token)
+	val := const_expr()
+	expect(',')
+	msg := tokens.data[pos].(*Token)
+	if msg.ty != TK_STR {
+		bad_token(msg, "string literal expected")
+	}
+	pos++
+	expect(')')
+	expect(';')
+	if val == 0 {
+		bad_token(t, format("static assertion failed: %s", msg.str))
+	}
+}
+
+// Reads a toplevel definition or declaration and appends
+// the resulting nodes to v.
+func toplevel(v *Vector) {
+	if consume(TK_ASSERT) {
+		static_assert()
+		return
+	}
+
 	is_typedef := consume(TK_TYPEDEF)
 	is_extern := consume(TK_EXTERN)
 
 	ty := decl_specifiers()
+	if consume(';') {
+		return
+	}
+
+	// Typedef
+	if is_typedef {
+		for {
+			node := declarator(ty)
+			t := tokens.data[pos].(*Token)
+			if t.ty == '{' {
+				bad_token(t, "typedef has function definition")
+			}
+			map_put(penv.typedefs, node.name, node.ty)
+			if !consume(',') {
+				break
+			}
+		}
+		expect(';')
+		return
+	}
+
+	// Global variables
+	if !is_funcdef() {
+		for {
+			node := declarator(ty)
+			node.is_extern = is_extern
+			map_put(penv.vars, node.name, node.ty)
+			vec_push(v, node)
+			if !consume(',') {
+				break
+			}
+		}
+		expect(';')
+		return
+	}
+
 	for consume('*') {
 		ty = ptr_to(ty)
 	}
 
-	name := ident()
-
 	// Function
-	if consume('(') {
-		node := new(Node)
-		node.name = name
-		node.args = new_vec()
+	t := tokens.data[pos].(*Token)
+	name := ident()
+	expect('(')
+	node := new(Node)
+	node.name = name
+	node.token = t
+	node.args = new_vec()
 
-		node.ty = new(Type)
-		node.ty.ty = FUNC
-		node.ty.returning = ty
+	node.ty = func_of(ty)
 
-		if !consume(')') {
-			vec_push(node.args, param_declaration())
-			for consume(',') {
-				vec_push(node.args, param_declaration())
+	if !consume(')') {
+		vec_push(node.args, param_declaration())
+		for consume(',') {
+			if consume(TK_ELLIPSIS) {
+				node.is_variadic = true
+				break
 			}
-			expect(')')
+			vec_push(node.args, param_declaration())
 		}
+		expect(')')
 
-		if consume(';') {
-			node.op = ND_DECL
-			return node
+		node.ty.params = new_vec()
+		for i := 0; i < node.args.len; i++ {
+			vec_push(node.ty.params, node.args.data[i].(*Node).ty)
 		}
+		node.ty.is_variadic = node.is_variadic
+	}
 
-		node.op = ND_FUNC
-		t := tokens.data[pos].(*Token)
-		expect('{')
-		if is_typedef {
-			bad_token(t, "typedef has function definition")
-		}
-		node.body = compound_stmt()
-		return node
+	if consume(';') {
+		node.op = ND_DECL
+		vec_push(v, node)
+		return
 	}
 
-	ty = read_array(ty)
-	expect(';')
+	node.op = ND_FUNC
+	expect('{')
+	labels = new_map()
+	gotos = new_vec()
 
-	if is_typedef {
-		map_put(penv.typedefs, name, ty)
-		return nil
+	// Parameters are in a scope enclosing the body, so that they
+	// hide typedefs of the same names.
+	penv = new_penv(penv)
+	for i := 0; i < node.args.len; i++ {
+		arg := node.args.data[i].(*Node)
+		map_put(penv.vars, arg.name, arg.ty)
 	}
+	node.body = compound_stmt()
+	penv = penv.next
 
-	// Global variable
-	node := new(Node)
-	node.op = ND_VARDEF
-	node.ty = ty
-	node.name = name
-	node.is_extern = is_extern
-
-	if !is_extern {
-		node.data = ""
-		node.len = node.ty.size
+	// A goto may jump forward, so labels are checked at the end
+	// of a function.
+	for i := 0; i < gotos.len; i++ {
+		t := gotos.data[i].(*Token)
+		if map_get(labels, t.name) == nil {
+			bad_token(t, format("label used but not defined: %s", t.name))
+		}
 	}
-	return node
+	vec_push(v, node)
 }
 
 func parse(tokens_ *Vector) *Vector {
 	tokens = tokens_
 	pos = 0
+	switches = new_vec()
 	penv = new_penv(penv)
 
 	v := new_vec()
@@ -785,9 +1845,6 @@ func parse(tokens_ *Vector) *Vector {
 		if t.ty == TK_EOF {
 			return v
 		}
-		node := toplevel()
-		if node != nil {
-			vec_push(v, node)
-		}
+		toplevel(v)
 	}
 }
@@ -2,9 +2,16 @@ package main
 
 // C preprocessor
 
+import (
+	"path/filepath"
+)
+
 var (
 	macros *Map
 	ctx_p  *Context_p
+
+	// Canonical paths of files containing `#pragma once`
+	once_files *Map
 )
 
 const (
@@ -94,11 +101,24 @@ func read_until_eol() *Vector {
 	return v
 }
 
-func new_int_p(val int) *Token {
-	t := new(Token)
+// Returns a number token for __LINE__ expanded at a given token.
+// It takes the position of the token so that the number has the
+// line of the expansion site and diagnostics point there.
+func line_token(at *Token) *Token {
+	t := *at
 	t.ty = TK_NUM
-	t.val = val
-	return t
+	t.val = at.line
+	t.name = ""
+	return &t
+}
+
+// Adds a token of a macro expanded at a given token.
+func add_expanded(t, at *Token) {
+	if is_ident(t, "__LINE__") {
+		add_p(line_token(at))
+		return
+	}
+	add_p(t)
 }
 
 func new_param(val int) *Token {
@@ -210,7 +230,9 @@ func stringize(tokens *Vector) *Token {
 
 func apply(m *Macro, start *Token) {
 	if m.ty == OBJLIKE {
-		append_p(m.tokens)
+		for i := 0; i < m.tokens.len; i++ {
+			add_expanded(m.tokens.data[i].(*Token), start)
+		}
 		return
 	}
 
@@ -224,20 +246,18 @@ func apply(m *Macro, start *Token) {
 	for i := 0; i < m.tokens.len; i++ {
 		t := m.tokens.data[i].(*Token)
 
-		if is_ident(t, "__LINE__") {
-			add_p(new_int_p(line(t)))
-			continue
-		}
-
 		if t.ty == TK_PARAM {
 			if t.stringize {
 				add_p(stringize(args.data[t.val].(*Vector)))
-			} else {
-				append_p(args.data[t.val].(*Vector))
+				continue
+			}
+			arg := args.data[t.val].(*Vector)
+			for j := 0; j < arg.len; j++ {
+				add_expanded(arg.data[j].(*Token), start)
 			}
 			continue
 		}
-		add_p(t)
+		add_expanded(t, start)
 	}
 }
 
@@ -266,22 +286,53 @@ func define() {
 	objlike_macro(name)
 }
 
+// Returns an absolute path with symbolic links resolved so that
+// different spellings of the same file compare equal.
+func canonical_path(path string) string {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if q, err := filepath.EvalSymlinks(p); err == nil {
+		return q
+	}
+	return p
+}
+
 func include() {
 	t := get(TK_STR, "string expected")
 	path := t.str
 	get('\n', "newline expected")
+	if map_get(once_files, canonical_path(path)) != nil {
+		return
+	}
 	append_p(tokenize(path, false))
 }
 
+// `#pragma once` marks the current file so that it is not included
+// again. Other pragmas are ignored.
+func pragma(t *Token) {
+	v := read_until_eol()
+	if v.len == 1 && is_ident(v.data[0].(*Token), "once") {
+		map_put(once_files, canonical_path(t.path), true)
+	}
+}
+
 func preprocess(tokens *Vector) *Vector {
 	if macros == nil {
 		macros = new_map()
+		once_files = new_map()
 	}
 	ctx_p = new_ctx_p(ctx_p, tokens)
 
 	for !eof() {
 		t := next()
 
+		if is_ident(t, "__LINE__") {
+			add_p(line_token(t))
+			continue
+		}
+
 		if t.ty == TK_IDENT {
 			m := map_get(macros, t.name)
 			if m != nil {
@@ -303,6 +354,8 @@ func preprocess(tokens *Vector) *Vector {
 			define()
 		} else if strcmp(t.name, "include") == 0 {
 			include()
+		} else if strcmp(t.name, "pragma") == 0 {
+			pragma(t)
 		} else {
 			bad_token(t, "unknown directive")
 		}
@@ -4,79 +4,303 @@ package main
 //
 // Before this pass, it is assumedd that we have infinite number of
 // registers. This pass maps them to a finite number of registers.
-// We actually have only 7 registers.
+// We actually have only 7 registers, or 8 with -fomit-frame-pointer.
 //
-// We allocate registers only within a single expression. In other
-// words, there are no registers that live beyond semicolons.
-// This design choice simplifies the implementation a lot, since
-// practically we don't have to thinl about the case in which
-// registers are exhausted and need to be spilled to memory.
+// This is a linear-scan allocator. We first compute the live interval
+// of each virtual register, which spans from the first instruction
+// that mentions it to the last one. If a backward jump leaves an
+// interval, the interval is extended to the jump, since the register
+// is needed again in the next iteration. Then we scan instructions
+// in order, giving a physical register to each interval when it
+// starts and taking it back when it ends. IR_KILL is not needed for
+// that and is just removed.
+//
+// If registers are exhausted, the register whose interval ends last
+// is spilled: it is given a stack slot and lives there from the point
+// it is defined, and allocation starts over. Each instruction that
+// uses a spilled register loads it to a scratch register before
+// the instruction and stores it back after that. Since a spilled
+// register is in memory on every path, branches need no special care.
 
 var (
-	used       []bool
-	reg_map    [8192]int
-	reg_map_sz = len(reg_map)
+	used    []bool
+	reg_map []int
+	owner   []int // physical register -> virtual register
+	spilled []int // virtual register -> stack offset, or 0
+
+	// Live interval of each virtual register, by instruction index.
+	// start is -1 if the register is not used.
+	start []int
+	end   []int
 )
 
-func alloc(ir_reg int) int {
-	if reg_map[ir_reg] != -1 {
-		r := reg_map[ir_reg]
-		//assert("used[r])
-		return r
+// Returns pointers to the virtual registers an instruction refers to.
+func reg_operands(ir *IR) []*int {
+	switch irinfo[ir.op].ty {
+	case IR_TY_BINARY:
+		if ir.is_imm {
+			return []*int{&ir.lhs}
+		}
+		return []*int{&ir.lhs, &ir.rhs}
+	case IR_TY_REG, IR_TY_REG_IMM, IR_TY_REG_LABEL, IR_TY_LABEL_ADDR:
+		return []*int{&ir.lhs}
+	case IR_TY_MEM, IR_TY_REG_REG, IR_TY_BR:
+		return []*int{&ir.lhs, &ir.rhs}
+	case IR_TY_CALL:
+		v := []*int{&ir.lhs}
+		for i := 0; i < ir.nargs; i++ {
+			v = append(v, &ir.args[i])
+		}
+		return v
+	}
+	return nil
+}
+
+// Returns the label an instruction jumps to, or 0.
+func jump_target(ir *IR) int {
+	switch ir.op {
+	case IR_JMP:
+		return ir.lhs
+	case IR_IF, IR_UNLESS:
+		return ir.rhs
+	case IR_BR:
+		return ir.label
+	}
+	return 0
+}
+
+func live_intervals(irv *Vector) {
+	for i := range start {
+		start[i] = -1
+		end[i] = -1
 	}
 
+	labels := make([]int, nlabel)
+	var vregs []int
+	for i := 0; i < irv.len; i++ {
+		ir := irv.data[i].(*IR)
+		if ir.op == IR_LABEL {
+			labels[ir.lhs] = i
+			continue
+		}
+		if ir.op == IR_KILL {
+			continue
+		}
+		for _, p := range reg_operands(ir) {
+			if start[*p] == -1 {
+				start[*p] = i
+				vregs = append(vregs, *p)
+			}
+			end[*p] = i
+		}
+	}
+
+	// Backward jumps, i.e. the ends of loops
+	var jumps []int
+	for i := 0; i < irv.len; i++ {
+		l := jump_target(irv.data[i].(*IR))
+		if l != 0 && labels[l] <= i {
+			jumps = append(jumps, i)
+		}
+	}
+
+	// Extend intervals that are live at the head of a loop
+	// to the end of the loop. Extending one interval may make
+	// it live at the head of an outer loop, so repeat.
+	for changed := true; changed; {
+		changed = false
+		for _, i := range jumps {
+			head := labels[jump_target(irv.data[i].(*IR))]
+			for _, r := range vregs {
+				if start[r] < head && head <= end[r] && end[r] < i {
+					end[r] = i
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// Returns true if an instruction writes to its lhs register.
+func writes_lhs(op int) bool {
+	switch op {
+	case IR_RETURN, IR_STORE, IR_IF, IR_UNLESS, IR_BR:
+		return false
+	}
+	return true
+}
+
+func contains(v []int, x int) bool {
+	for _, y := range v {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a free physical register. If there is none, a virtual
+// register not in busy is chosen to be spilled and -1 is returned.
+func find_reg(fn *Function, busy []int) int {
 	for i := 0; i < num_regs; i++ {
-		if used[i] == true {
+		if !used[i] {
+			used[i] = true
+			return i
+		}
+	}
+
+	victim := -1
+	for i := 0; i < num_regs; i++ {
+		r := owner[i]
+		if r == -1 || contains(busy, r) {
 			continue
 		}
-		reg_map[ir_reg] = i
-		used[i] = true
-		return i
+		if victim == -1 || end[r] > end[victim] {
+			victim = r
+		}
 	}
-	error("register exhausted")
+	if victim == -1 {
+		error("register exhausted")
+	}
+
+	fn.stacksize = roundup(fn.stacksize, 8) + 8
+	spilled[victim] = fn.stacksize
 	return -1
 }
 
-func visit(irv *Vector) {
-	for i := 0; i < irv.len; i++ {
-		ir := irv.data[i].(*IR)
+func spill_ir(op, r, off int) *IR {
+	ir := new(IR)
+	ir.op = op
+	ir.lhs = r
+	ir.rhs = off
+	return ir
+}
 
-		switch irinfo[ir.op].ty {
-		case IR_TY_BINARY:
-			ir.lhs = alloc(ir.lhs)
-			if !ir.is_imm {
-				ir.rhs = alloc(ir.rhs)
-			}
-		case IR_TY_REG, IR_TY_REG_IMM, IR_TY_REG_LABEL, IR_TY_LABEL_ADDR:
-			ir.lhs = alloc(ir.lhs)
-		case IR_TY_MEM, IR_TY_REG_REG:
-			ir.lhs = alloc(ir.lhs)
-			ir.rhs = alloc(ir.rhs)
-		case IR_TY_CALL:
-			ir.lhs = alloc(ir.lhs)
-			for i := 0; i < ir.nargs; i++ {
-				ir.args[i] = alloc(ir.args[i])
+// Maps virtual registers to physical ones. If rewrite is false,
+// instructions are not changed and false is returned as soon as
+// a register is spilled, so that the caller can start over.
+func visit(fn *Function, rewrite bool) bool {
+	for i := range used {
+		used[i] = false
+		owner[i] = -1
+	}
+	for i := range reg_map {
+		reg_map[i] = -1
+	}
+
+	v := new_vec()
+	for i := 0; i < fn.ir.len; i++ {
+		ir := fn.ir.data[i].(*IR)
+
+		// Expire intervals that ended before this instruction.
+		for p := 0; p < num_regs; p++ {
+			if r := owner[p]; r != -1 && end[r] < i {
+				used[p] = false
+				owner[p] = -1
 			}
 		}
 
 		if ir.op == IR_KILL {
-			//assert(used[ir.lhs])
-			used[ir.lhs] = false
-			ir.op = IR_NOP
+			continue
+		}
+
+		ops := reg_operands(ir)
+		var busy []int
+		for _, p := range ops {
+			busy = append(busy, *p)
+		}
+
+		// Spilled registers get scratch registers only for
+		// this instruction.
+		var scratch []int // virtual register, physical register, ...
+		for _, p := range ops {
+			r := *p
+			phys := -1
+
+			if spilled[r] == 0 {
+				if reg_map[r] == -1 {
+					reg_map[r] = find_reg(fn, busy)
+					if reg_map[r] == -1 {
+						return false
+					}
+					owner[reg_map[r]] = r
+				}
+				phys = reg_map[r]
+			} else {
+				for j := 0; j < len(scratch); j += 2 {
+					if scratch[j] == r {
+						phys = scratch[j+1]
+					}
+				}
+				if phys == -1 {
+					phys = find_reg(fn, busy)
+					if phys == -1 {
+						return false
+					}
+					scratch = append(scratch, r, phys)
+					if rewrite {
+						vec_push(v, spill_ir(IR_LOAD_SPILL, phys, spilled[r]))
+					}
+				}
+			}
+
+			if rewrite {
+				*p = phys
+			}
+		}
+
+		// A call clobbers the registers that are not callee-saved,
+		// so they need saving if their values are used later.
+		if rewrite && ir.op == IR_CALL {
+			ir.live_regs = nil
+			for p := 0; p < num_regs; p++ {
+				r := owner[p]
+				if r != -1 && r != busy[0] && end[r] > i && !is_callee_saved(p) {
+					ir.live_regs = append(ir.live_regs, p)
+				}
+			}
 		}
+
+		if rewrite {
+			vec_push(v, ir)
+		}
+		for j := 0; j < len(scratch); j += 2 {
+			r, phys := scratch[j], scratch[j+1]
+			if rewrite && r == busy[0] && writes_lhs(ir.op) {
+				vec_push(v, spill_ir(IR_STORE_SPILL, phys, spilled[r]))
+			}
+			used[phys] = false
+		}
+	}
+
+	if rewrite {
+		fn.ir = v
 	}
+	return true
 }
 
 func alloc_regs(fns *Vector) {
 
-	used = make([]bool, num_regs)
-
-	for i := 0; i < reg_map_sz; i++ {
-		reg_map[i] = -1
+	if omit_frame_pointer {
+		num_regs = len(regs)
 	}
 
+	reg_map = make([]int, nreg)
+	spilled = make([]int, nreg)
+	start = make([]int, nreg)
+	end = make([]int, nreg)
+
 	for i := 0; i < fns.len; i++ {
 		fn := fns.data[i].(*Function)
-		visit(fn.ir)
+
+		// Sized by the whole pool so that any register gen_x86
+		// knows about can be marked, however many are allocatable.
+		used = make([]bool, len(regs))
+		owner = make([]int, len(regs))
+
+		live_intervals(fn.ir)
+		for !visit(fn, false) {
+		}
+		visit(fn, true)
 	}
 }
@@ -0,0 +1,89 @@
+package main
+
+// Unit tests for the register allocator
+
+import (
+	"testing"
+)
+
+func new_test_fn(irs ...*IR) *Function {
+	fn := new(Function)
+	fn.ir = new_vec()
+	for _, ir := range irs {
+		vec_push(fn.ir, ir)
+	}
+	return fn
+}
+
+// Saves the allocator's globals and returns a function that
+// restores them, so that a test does not leak its state.
+func save_globals() func() {
+	nreg0, nlabel0, num_regs0 := nreg, nlabel, num_regs
+	used0, reg_map0, owner0, spilled0 := used, reg_map, owner, spilled
+	start0, end0 := start, end
+	return func() {
+		nreg, nlabel, num_regs = nreg0, nlabel0, num_regs0
+		used, reg_map, owner, spilled = used0, reg_map0, owner0, spilled0
+		start, end = start0, end0
+	}
+}
+
+func run_alloc_regs(fn *Function, regs_used, labels_used int) {
+	nreg, nlabel = regs_used, labels_used
+	fns := new_vec()
+	vec_push(fns, fn)
+	alloc_regs(fns)
+}
+
+// Registers must be reused after their last use even without IR_KILL.
+func Test_alloc_regs_without_kill(t *testing.T) {
+	defer save_globals()()
+
+	var irs []*IR
+	for r := 1; r <= 20; r++ {
+		irs = append(irs, &IR{op: IR_IMM, lhs: r, rhs: r})
+		irs = append(irs, &IR{op: IR_RETURN, lhs: r})
+	}
+	fn := new_test_fn(irs...)
+	run_alloc_regs(fn, 21, 1)
+
+	if fn.stacksize != 0 {
+		t.Errorf("expected no spill, got stacksize %d", fn.stacksize)
+	}
+	for i := 0; i < fn.ir.len; i++ {
+		ir := fn.ir.data[i].(*IR)
+		if ir.lhs != 0 {
+			t.Errorf("expected r0 at %d, got r%d", i, ir.lhs)
+		}
+	}
+}
+
+// A register used in a loop must not be reused by another one
+// defined later in the same loop.
+func Test_alloc_regs_loop(t *testing.T) {
+	defer save_globals()()
+
+	fn := new_test_fn(
+		&IR{op: IR_IMM, lhs: 1, rhs: 1},
+		&IR{op: IR_LABEL, lhs: 1},
+		&IR{op: IR_IMM, lhs: 2, rhs: 0},
+		&IR{op: IR_ADD, lhs: 2, rhs: 1},
+		&IR{op: IR_IMM, lhs: 3, rhs: 5},
+		&IR{op: IR_RETURN, lhs: 3},
+		&IR{op: IR_JMP, lhs: 1},
+	)
+
+	nlabel = 2
+	start, end = make([]int, 4), make([]int, 4)
+	live_intervals(fn.ir)
+	if end[1] != 6 {
+		t.Errorf("expected r1 to live until 6, got %d", end[1])
+	}
+
+	run_alloc_regs(fn, 4, 2)
+	r1 := fn.ir.data[0].(*IR).lhs
+	r3 := fn.ir.data[4].(*IR).lhs
+	if r1 == r3 {
+		t.Errorf("r1 and r3 share a register")
+	}
+}
@@ -18,18 +18,28 @@ package main
 // - Scales operands for pointer arithmetic. E.g. ptr+1 becomes ptr+4
 //   for integer and becomes ptr+8 for pointer.
 //
-// - Reject bad assignments, such as `1=2+3`.
-
-import (
-	"fmt"
-	"os"
-)
+// - Reject bad assignments, such as `1=2+3`, and other operators
+//   that need an lvalue, such as `&3` and `3++`.
+//
+// - Reject `break` and `continue` outside of a loop or switch.
+//
+// - Warn calls to undeclared functions.
 
 var (
 	globals   *Vector
+	curfn     *Node
 	stacksize int
-	str_label int
-	env       *Env
+
+	// `return` in a statement expression gives its value, so it is
+	// not checked against the function's return type.
+	stmt_expr_depth int
+	str_label       int
+	env             *Env
+
+	// The number of enclosing statements that `break` and
+	// `continue` can jump out of.
+	break_depth    int
+	continue_depth int
 )
 
 type Env struct {
@@ -71,7 +81,20 @@ func swap(p, q **Node) {
 }
 
 func maybe_decay(base *Node, decay bool) *Node {
-	if !decay || base.ty.ty != ARY {
+	if !decay {
+		return base
+	}
+
+	// A function designator is converted to a pointer to the function.
+	if base.ty.ty == FUNC {
+		node := new(Node)
+		node.op = ND_ADDR
+		node.ty = ptr_to(base.ty)
+		node.expr = base
+		return node
+	}
+
+	if base.ty.ty != ARY {
 		return base
 	}
 
@@ -82,33 +105,170 @@ func maybe_decay(base *Node, decay bool) *Node {
 	return node
 }
 
-func check_lval(node *Node) {
+func is_bitfield(node *Node) bool {
+	return node.op == ND_DOT && node.ty.bit_width > 0
+}
+
+// Reports an error if node is not an lvalue. what tells where the
+// lvalue is required, such as "unary '&' operand".
+func check_lval(node *Node, t *Token, what string) {
 	op := node.op
-	if op != ND_LVAR && op != ND_GVAR && op != ND_DEREF && op != ND_DOT {
-		error("not an lvalue: %d (%s)", op, node.name)
+	if op == ND_LVAR || op == ND_GVAR || op == ND_DEREF || op == ND_DOT {
+		return
+	}
+	if t != nil {
+		bad_token(t, "lvalue required as "+what)
 	}
+	error("lvalue required as %s", what)
 }
 
 func new_int(val int) *Node {
 	node := new(Node)
 	node.op = ND_NUM
-	node.ty = new(Type)
-	node.ty.ty = INT
+	node.ty = int_tyf()
 	node.val = val
 	return node
 }
 
 func scale_ptr(node *Node, ty *Type) *Node {
+	// A char pointer moves one byte at a time, so there is
+	// nothing to multiply.
+	if ty.ptr_to.size == 1 {
+		return node
+	}
+
 	e := new(Node)
 	e.op = '*'
+	e.ty = long_tyf()
 	e.lhs = node
 	e.rhs = new_int(ty.ptr_to.size)
 	return e
 }
 
+// Returns the type of an arithmetic operation. Operands narrower
+// than int are promoted to int, and if either side is long, so is
+// the result. The result is unsigned if an operand as wide as it
+// is unsigned.
+func arith_ty(lhs, rhs *Type) *Type {
+	ty := int_tyf()
+	if lhs.size == 8 || rhs.size == 8 {
+		ty = long_tyf()
+	}
+	ty.is_unsigned = (lhs.size == ty.size && lhs.is_unsigned) ||
+		(rhs.size == ty.size && rhs.is_unsigned)
+	return ty
+}
+
+func same_type(x, y *Type) bool {
+	if x.ty != y.ty {
+		return false
+	}
+
+	switch x.ty {
+	case PTR:
+		return same_type(x.ptr_to, y.ptr_to)
+	case ARY:
+		return x.len == y.len && same_type(x.ary_of, y.ary_of)
+	case STRUCT:
+		return x.members == y.members
+	case FUNC:
+		return same_type(x.returning, y.returning)
+	}
+	return true
+}
+
+func is_integer(ty *Type) bool {
+	return ty.ty == INT || ty.ty == CHAR || ty.ty == SHORT || ty.ty == LONG
+}
+
+// An integer constant 0 is a null pointer constant, which converts
+// to any pointer type. Any other integer is not a pointer.
+func is_null_ptr(node *Node) bool {
+	return node.op == ND_NUM && node.val == 0
+}
+
+// Warns an assignment of a pointer to a pointer of a different type,
+// such as `char *p = &int_var`. A void pointer converts to and from
+// any other pointer, so it is always allowed.
+func check_ptr_assign(ty *Type, rhs *Node, t *Token) {
+	if ty.ty != PTR || t == nil {
+		return
+	}
+	if is_integer(rhs.ty) && !is_null_ptr(rhs) {
+		warn_token(t, "assignment makes pointer from integer")
+		return
+	}
+	if rhs.ty.ty != PTR || ty.ptr_to.ty == VOID || rhs.ty.ptr_to.ty == VOID {
+		return
+	}
+	if !same_type(ty.ptr_to, rhs.ty.ptr_to) {
+		warn_token(t, "assignment from incompatible pointer type")
+	}
+}
+
+// Warns `return;` in a function returning a value and `return x;`
+// in a void function.
+func check_return(node *Node) {
+	if stmt_expr_depth > 0 {
+		return
+	}
+	is_void := curfn.ty.returning.ty == VOID
+	if node.expr == nil && !is_void {
+		warn_token(node.token, "'return' with no value, in function returning non-void")
+	}
+	if node.expr != nil && is_void {
+		warn_token(node.token, "'return' with a value, in function returning void")
+	}
+}
+
+// Warns `p == 1`. Comparing a pointer with 0 is a null check.
+func check_ptr_cmp(node *Node) {
+	lhs, rhs := node.lhs, node.rhs
+	if rhs.ty.ty == PTR {
+		lhs, rhs = rhs, lhs
+	}
+	if lhs.ty.ty == PTR && is_integer(rhs.ty) && !is_null_ptr(rhs) {
+		warn_token(node.token, "comparison between pointer and integer")
+	}
+}
+
+// Converts an argument to the type of its parameter. Arguments
+// without a parameter, such as variadic ones, are passed as they are,
+// which is the default argument promotion since a char or an int is
+// already sign-extended to a full register.
+func conv_arg(node *Node, ty *Type) *Node {
+	if node.ty.ty == STRUCT || ty.ty == STRUCT || node.ty.size == ty.size {
+		return node
+	}
+	e := new_expr(ND_CAST, node)
+	e.ty = ty
+	return e
+}
+
+// Walks the body of a loop, in which both `break` and `continue`
+// are allowed.
+func walk_loop_body(node *Node) *Node {
+	break_depth++
+	continue_depth++
+	node = walk(node, true)
+	break_depth--
+	continue_depth--
+	return node
+}
+
 func walk(node *Node, decay bool) *Node {
 	switch node.op {
-	case ND_NUM, ND_NULL, ND_BREAK:
+	case ND_NUM, ND_NULL, ND_GOTO:
+		return node
+	case ND_BREAK:
+		if break_depth == 0 {
+			bad_token(node.token, "stray 'break' statement")
+		}
+		return node
+	case ND_CONTINUE:
+		if continue_depth == 0 {
+			bad_token(node.token, "stray 'continue' statement")
+		}
 		return node
 	case ND_STR:
 		{
@@ -147,8 +307,10 @@ func walk(node *Node, decay bool) *Node {
 		}
 	case ND_VARDEF:
 		{
-			stacksize = roundup(stacksize, node.ty.align)
+			// A variable occupies [rbp-offset, rbp-offset+size), so the
+			// offset itself must be a multiple of the alignment.
 			stacksize += node.ty.size
+			stacksize = roundup(stacksize, node.ty.align)
 			node.offset = stacksize
 			v := new(Var)
 			v.ty = node.ty
@@ -158,6 +320,12 @@ func walk(node *Node, decay bool) *Node {
 
 			if node.init != nil {
 				node.init = walk(node.init, true)
+				check_ptr_assign(node.ty, node.init, node.token)
+			}
+			if node.inits != nil {
+				for i := 0; i < node.inits.len; i++ {
+					node.inits.data[i] = walk(node.inits.data[i].(*Node), true)
+				}
 			}
 			return node
 		}
@@ -177,17 +345,36 @@ func walk(node *Node, decay bool) *Node {
 		if node.inc != nil {
 			node.inc = walk(node.inc, true)
 		}
-		node.body = walk(node.body, true)
+		node.body = walk_loop_body(node.body)
 		env = env.next
 		return node
 	case ND_DO_WHILE:
 		node.cond = walk(node.cond, true)
+		node.body = walk_loop_body(node.body)
+		return node
+	case ND_SWITCH:
+		node.cond = walk(node.cond, true)
+		break_depth++
+		node.body = walk(node.body, true)
+		break_depth--
+		return node
+	case ND_CASE, ND_DEFAULT, ND_LABEL:
 		node.body = walk(node.body, true)
 		return node
 	case '+', '-':
 		node.lhs = walk(node.lhs, true)
 		node.rhs = walk(node.rhs, true)
 
+		// The difference of two pointers is the number of elements
+		// between them, which has type ptrdiff_t (signed long).
+		if node.op == '-' && node.lhs.ty.ty == PTR && node.rhs.ty.ty == PTR {
+			node.ty = long_tyf()
+			e := new_binop('/', node, new_int(node.lhs.ty.ptr_to.size))
+			e.ty = node.ty
+			e.is_exact = true
+			return e
+		}
+
 		if node.rhs.ty.ty == PTR {
 			swap(&node.lhs, &node.rhs)
 		}
@@ -197,13 +384,15 @@ func walk(node *Node, decay bool) *Node {
 
 		if node.lhs.ty.ty == PTR {
 			node.rhs = scale_ptr(node.rhs, node.lhs.ty)
+			node.ty = node.lhs.ty
+			return node
 		}
 
-		node.ty = node.lhs.ty
+		node.ty = arith_ty(node.lhs.ty, node.rhs.ty)
 		return node
 	case ND_ADD_EQ, ND_SUB_EQ:
 		node.lhs = walk(node.lhs, false)
-		check_lval(node.lhs)
+		check_lval(node.lhs, node.token, "left operand of assignment")
 		node.rhs = walk(node.rhs, true)
 		node.ty = node.lhs.ty
 
@@ -213,9 +402,12 @@ func walk(node *Node, decay bool) *Node {
 		return node
 	case '=', ND_MUL_EQ, ND_DIV_EQ, ND_MOD_EQ, ND_SHL_EQ, ND_SHR_EQ, ND_BITAND_EQ, ND_XOR_EQ, ND_BITOR_EQ:
 		node.lhs = walk(node.lhs, false)
-		check_lval(node.lhs)
+		check_lval(node.lhs, node.token, "left operand of assignment")
 		node.rhs = walk(node.rhs, true)
 		node.ty = node.lhs.ty
+		if node.op == '=' {
+			check_ptr_assign(node.ty, node.rhs, node.token)
+		}
 		return node
 
 	case ND_DOT:
@@ -240,27 +432,78 @@ func walk(node *Node, decay bool) *Node {
 		error("member missing: %s", node.name)
 	case '?':
 		node.cond = walk(node.cond, true)
-		node.then = walk(node.then, true)
 		node.els = walk(node.els, true)
+		if node.then == nil {
+			node.ty = node.cond.ty
+			return node
+		}
+		node.then = walk(node.then, true)
 		node.ty = node.then.ty
 		return node
-	case '*', '/', '%', '<', '|', '^', '&', ND_EQ, ND_NE, ND_LE, ND_SHL, ND_SHR, ND_LOGAND, ND_LOGOR:
+	case '*', '/', '%', '|', '^', '&':
 		node.lhs = walk(node.lhs, true)
 		node.rhs = walk(node.rhs, true)
-		node.ty = node.lhs.ty
+		node.ty = arith_ty(node.lhs.ty, node.rhs.ty)
+		return node
+	case ND_SHL, ND_SHR:
+		// The result has the promoted type of the left operand.
+		node.lhs = walk(node.lhs, true)
+		node.rhs = walk(node.rhs, true)
+		node.ty = arith_ty(node.lhs.ty, &int_ty)
+		return node
+	case '<', ND_EQ, ND_NE, ND_LE, ND_LOGAND, ND_LOGOR:
+		node.lhs = walk(node.lhs, true)
+		node.rhs = walk(node.rhs, true)
+		node.ty = int_tyf()
+		if node.op == ND_EQ || node.op == ND_NE {
+			check_ptr_cmp(node)
+		}
 		return node
 	case ',':
 		node.lhs = walk(node.lhs, true)
 		node.rhs = walk(node.rhs, true)
 		node.ty = node.rhs.ty
 		return node
-	case ND_POST_INC, ND_POST_DEC, ND_NEG, '!', '~':
-		node.expr = walk(node.expr, true)
+	case ND_POST_INC:
+		node.expr = walk(node.expr, false)
+		check_lval(node.expr, node.token, "increment operand")
+		node.ty = node.expr.ty
+		return node
+	case ND_POST_DEC:
+		node.expr = walk(node.expr, false)
+		check_lval(node.expr, node.token, "decrement operand")
 		node.ty = node.expr.ty
 		return node
+	case ND_CAST:
+		node.expr = walk(node.expr, true)
+		if node.ty.ty == VOID {
+			return node
+		}
+		if node.ty.ty != PTR && !is_integer(node.ty) {
+			bad_token(node.token, "conversion to non-scalar type requested")
+		}
+		if node.expr.ty.ty != PTR && !is_integer(node.expr.ty) {
+			bad_token(node.token, "scalar value required in cast")
+		}
+		return node
+	case ND_NEG, '~':
+		node.expr = walk(node.expr, true)
+		node.ty = arith_ty(node.expr.ty, &int_ty)
+		return node
+	case '!':
+		node.expr = walk(node.expr, true)
+		node.ty = int_tyf()
+		return node
 	case ND_ADDR:
 		node.expr = walk(node.expr, true)
-		check_lval(node.expr)
+		check_lval(node.expr, node.token, "unary '&' operand")
+		if is_bitfield(node.expr) {
+			msg := "cannot take address of bit-field: " + node.expr.name
+			if node.token != nil {
+				bad_token(node.token, msg)
+			}
+			error("%s", msg)
+		}
 		node.ty = ptr_to(node.expr.ty)
 		return node
 	case ND_DEREF:
@@ -271,17 +514,35 @@ func walk(node *Node, decay bool) *Node {
 		}
 
 		if node.expr.ty.ptr_to.ty == VOID {
+			if node.token != nil {
+				bad_token(node.token, "cannot dereference void pointer")
+			}
 			error("cannot dereference void pointer")
 		}
 
 		node.ty = node.expr.ty.ptr_to
 		return maybe_decay(node, decay)
-	case ND_RETURN, ND_EXPR_STMT:
+	case ND_RETURN:
+		check_return(node)
+		// A function returns 0 if no value is given.
+		if node.expr == nil {
+			node.expr = new_int(0)
+		}
+		node.expr = walk(node.expr, true)
+		return node
+	case ND_EXPR_STMT:
 		node.expr = walk(node.expr, true)
 		return node
 	case ND_SIZEOF:
 		{
 			expr := walk(node.expr, false)
+			if is_bitfield(expr) {
+				msg := "sizeof applied to a bit-field: " + expr.name
+				if node.token != nil {
+					bad_token(node.token, msg)
+				}
+				error("%s", msg)
+			}
 			return new_int(expr.ty.size)
 		}
 	case ND_ALIGNOF:
@@ -291,19 +552,77 @@ func walk(node *Node, decay bool) *Node {
 		}
 	case ND_CALL:
 		{
+			// A function without a prototype may be variadic too.
 			v := find_var(node.name)
 			if v != nil && v.ty.ty == FUNC {
 				node.ty = v.ty.returning
+				node.is_variadic = v.ty.is_variadic || v.ty.params == nil
 			} else {
-				fmt.Fprintf(os.Stderr, "bad function: %s\n", node.name)
+				node.is_variadic = true
+				warn_token(node.token, format("implicit declaration of function '%s'", node.name))
 				node.ty = &int_ty
 			}
 
 			for i := 0; i < node.args.len; i++ {
-				node.args.data[i] = walk(node.args.data[i].(*Node), true)
+				arg := walk(node.args.data[i].(*Node), true)
+				if v != nil && v.ty.ty == FUNC && v.ty.params != nil && i < v.ty.params.len {
+					arg = conv_arg(arg, v.ty.params.data[i].(*Type))
+				}
+				node.args.data[i] = arg
+			}
+
+			// Arguments after the sixth are saved to a temporary
+			// area as they are evaluated, and pushed at the call.
+			if node.args.len > len(argregs) {
+				stacksize = roundup(stacksize, 8)
+				stacksize += (node.args.len - len(argregs)) * 8
+				node.offset = stacksize
 			}
 			return node
 		}
+	case ND_VA_START:
+		if !curfn.is_variadic {
+			error("va_start used in a non-variadic function: %s", curfn.name)
+		}
+		node.expr = walk(node.expr, false)
+		check_lval(node.expr, nil, "va_list argument")
+		if node.expr.ty.ty != PTR {
+			error("va_list must be a pointer")
+		}
+		// Points to the first unnamed argument in the register save area,
+		// or on the stack if all argument registers hold named ones.
+		if curfn.args.len < len(argregs) {
+			node.offset = curfn.va_offset - curfn.args.len*8
+		} else {
+			node.offset = -(16 + (curfn.args.len-len(argregs))*8)
+		}
+		node.ty = void_tyf()
+		return node
+	case ND_VA_ARG:
+		node.expr = walk(node.expr, false)
+		check_lval(node.expr, nil, "va_list argument")
+		if node.expr.ty.ty != PTR {
+			error("va_list must be a pointer")
+		}
+		if curfn.is_variadic {
+			node.is_variadic = true
+			node.va_offset = curfn.va_offset
+		}
+		return node
+	case ND_TRAP, ND_UNREACHABLE:
+		node.ty = void_tyf()
+		return node
+	case ND_STRUCT_EQ:
+		node.lhs = walk(node.lhs, true)
+		node.rhs = walk(node.rhs, true)
+		if node.lhs.ty.ty != STRUCT || node.rhs.ty.ty != STRUCT {
+			error("__builtin_struct_eq: struct expected")
+		}
+		if node.lhs.ty.members != node.rhs.ty.members {
+			error("__builtin_struct_eq: incompatible struct types")
+		}
+		node.ty = int_tyf()
+		return node
 	case ND_COMP_STMT:
 		{
 			env = new_env(env)
@@ -313,9 +632,22 @@ func walk(node *Node, decay bool) *Node {
 			env = env.next
 			return node
 		}
+	case ND_DECL_LIST:
+		for i := 0; i < node.stmts.len; i++ {
+			node.stmts.data[i] = walk(node.stmts.data[i].(*Node), true)
+		}
+		return node
 	case ND_STMT_EXPR:
+		stmt_expr_depth++
 		node.body = walk(node.body, true)
+		stmt_expr_depth--
 		node.ty = &int_ty
+		if node.body.stmts.len > 0 {
+			last := vec_last(node.body.stmts).(*Node)
+			if last.op == ND_EXPR_STMT && last.expr.ty.ty != STRUCT {
+				node.ty = last.expr.ty
+			}
+		}
 		return node
 	default:
 		//assert(0 && "unknouwn node type")
@@ -323,6 +655,46 @@ func walk(node *Node, decay bool) *Node {
 	return nil
 }
 
+// A global initializer must be a link-time constant. Besides an
+// integer constant expression, we accept `&var`, an array or a
+// function name, which are all resolved to an address of a global
+// symbol.
+func global_reloc(node *Node) string {
+	node = walk(node, true)
+	if node.op != ND_ADDR || node.expr.op != ND_GVAR {
+		error("initializer element is not constant")
+	}
+	return node.expr.name
+}
+
+// Returns the type of the operand of sizeof in a constant expression,
+// which is read before sema runs. Variables are looked up by their
+// types recorded in the parser's scopes.
+func const_operand_type(node *Node) *Type {
+	orig_env, orig_globals, orig_label := env, globals, str_label
+
+	var scopes []*PEnv
+	for e := penv; e != nil; e = e.next {
+		scopes = append(scopes, e)
+	}
+	env = nil
+	for i := len(scopes) - 1; i >= 0; i-- {
+		env = new_env(env)
+		vars := scopes[i].vars
+		for j := 0; j < vars.keys.len; j++ {
+			v := new(Var)
+			v.ty = vars.vals.data[j].(*Type)
+			v.name = vars.keys.data[j].(string)
+			map_put(env.vars, v.name, v)
+		}
+	}
+	globals = new_vec()
+
+	ty := walk(node, false).ty
+	env, globals, str_label = orig_env, orig_globals, orig_label
+	return ty
+}
+
 func sema(nodes *Vector) *Vector {
 	env = new_env(nil)
 	globals = new_vec()
@@ -333,6 +705,18 @@ func sema(nodes *Vector) *Vector {
 		if node.op == ND_VARDEF {
 			v := new_global(node.ty, node.name, node.data, node.len)
 			v.is_extern = node.is_extern
+			if node.inits != nil {
+				error("aggregate initializer for a global variable is not supported: %s", node.name)
+			}
+			if node.init != nil && is_integer(node.ty) {
+				// Truncated to the size of the variable as by an
+				// assignment.
+				n := uint(64 - node.ty.size*8)
+				v.has_val = true
+				v.val = eval(node.init, node.token) << n >> n
+			} else if node.init != nil {
+				v.reloc = global_reloc(node.init)
+			}
 			vec_push(globals, v)
 			map_put(env.vars, node.name, v)
 			continue
@@ -347,10 +731,32 @@ func sema(nodes *Vector) *Vector {
 			continue
 		}
 
+		curfn = node
 		stacksize = 0
 
+		// A variadic function saves all argument registers to a
+		// contiguous area so that unnamed arguments can be walked.
+		if node.is_variadic {
+			stacksize = roundup(stacksize, 8)
+			stacksize += len(argregs) * 8
+			node.va_offset = stacksize
+		}
+
 		for i := 0; i < node.args.len; i++ {
-			node.args.data[i] = walk(node.args.data[i].(*Node), true)
+			arg := node.args.data[i].(*Node)
+			if i < len(argregs) {
+				node.args.data[i] = walk(arg, true)
+				continue
+			}
+
+			// Arguments after the sixth are passed on the stack
+			// above the return address, and are used right there.
+			arg.offset = -(16 + (i-len(argregs))*8)
+			v := new(Var)
+			v.ty = arg.ty
+			v.is_local = true
+			v.offset = arg.offset
+			map_put(env.vars, arg.name, v)
 		}
 		node.body = walk(node.body, true)
 
@@ -0,0 +1,12 @@
+// Taking the address of a bitfield is an error.
+
+struct flags {
+    int a : 3;
+    int b : 5;
+};
+
+int main() {
+    struct flags f;
+    int *p = &f.b;
+    return 0;
+}
@@ -0,0 +1,11 @@
+// Applying sizeof to a bitfield is an error.
+
+struct flags {
+    int a : 3;
+    int b : 5;
+};
+
+int main() {
+    struct flags f;
+    return sizeof(f.a);
+}
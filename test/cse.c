@@ -0,0 +1,9 @@
+// With -O1, the second a*b reuses the first result.
+
+int mul2(int a, int b) {
+    return a * b + a * b;
+}
+
+int main() {
+    return mul2(3, 5) != 30;
+}
@@ -0,0 +1,20 @@
+// With -O1, arithmetic on constants is computed at compile time.
+
+int div0(int x) {
+    if (x)
+        return 1 / 0;
+    return 0;
+}
+
+int main() {
+    if (2 + 3 * 4 != 14) return 1;
+    if (2 - 5 * 3 != -13) return 2;
+    if (-7 / 2 != -3) return 3;
+    if (100 / 3 / 3 != 11) return 4;
+    long m = 1000000;
+    if (m * 1000000 / 1000000 != 1000000) return 5;
+    int x = 3;
+    if (x * (4 + 5) != 27) return 6;
+    if (({ int y = 2 + 2; y * y; }) != 16) return 7;
+    return div0(0);
+}
@@ -0,0 +1,40 @@
+// At -O1, a comparison tested by a branch becomes a conditional
+// jump without making a 0/1 value, even under `!`.
+
+int is_not_lt(int a, int b) { if (!(a < b)) return 1; return 0; }
+int is_lt(int a, int b) { if (a < b) return 1; return 0; }
+int is_le(int a, int b) { if (a <= b) return 1; return 0; }
+int is_gt(int a, int b) { if (a > b) return 1; return 0; }
+int is_eq(int a, int b) { if (!!(a == b)) return 1; return 0; }
+int is_ne(int a, int b) { if (!(a == b)) return 1; return 0; }
+int is_zero(int a) { if (!a) return 1; return 0; }
+
+int sum(int n) {
+    int s = 0;
+    for (int i = 0; i < n; i++)
+        s += i;
+    int j = 0;
+    while (!(j >= n))
+        j++;
+    do j--; while (j != 0);
+    return s + j;
+}
+
+int main() {
+    if (is_not_lt(1, 2) != 0) return 1;
+    if (is_not_lt(2, 2) != 1) return 2;
+    if (is_lt(1, 2) != 1) return 3;
+    if (is_lt(2, 1) != 0) return 4;
+    if (is_le(2, 2) != 1) return 5;
+    if (is_le(3, 2) != 0) return 6;
+    if (is_gt(3, 2) != 1) return 7;
+    if (is_gt(2, 2) != 0) return 8;
+    if (is_eq(-1, -1) != 1) return 9;
+    if (is_eq(1, 2) != 0) return 10;
+    if (is_ne(1, 2) != 1) return 11;
+    if (is_ne(2, 2) != 0) return 12;
+    if (is_zero(0) != 1) return 13;
+    if (is_zero(5) != 0) return 14;
+    if (sum(10) != 45) return 15;
+    return 0;
+}
@@ -2,3 +2,45 @@
 
 int global_arr[1] = {5};
 
+
+// Arguments after the sixth are passed on the stack.
+long weighted8(int a, int b, int c, int d, int e, int f, char g, long h) {
+    return a + b*2 + c*3 + d*4 + e*5 + f*6 + g*7 + h*8;
+}
+
+int add8(int a, int b, int c, int d, int e, int f, int g, int h);
+int call_add8(void) { return add8(1, 2, 3, 4, 5, 6, 7, 8); }
+
+// Returns rsp modulo 16 at the call site, which the ABI requires to be 0.
+__asm__(".global rsp_misalign\n"
+        "rsp_misalign:\n"
+        "\tleaq 8(%rsp), %rax\n"
+        "\tandq $15, %rax\n"
+        "\tret\n");
+
+// Calls uses_rbx() and returns 1 if rbx, which is callee-saved,
+// is preserved across the call.
+__asm__(".global rbx_preserved\n"
+        "rbx_preserved:\n"
+        "\tpush %rbx\n"
+        "\tmov $12345, %rbx\n"
+        "\tcall uses_rbx\n"
+        "\txor %eax, %eax\n"
+        "\tcmp $12345, %rbx\n"
+        "\tsete %al\n"
+        "\tpop %rbx\n"
+        "\tret\n");
+
+// Clobbers the scratch registers r10 and r11 as the ABI allows,
+// and returns 7.
+__asm__(".global clobber_scratch\n"
+        "clobber_scratch:\n"
+        "\tmov $-1, %r10\n"
+        "\tmov $-1, %r11\n"
+        "\tmov $7, %eax\n"
+        "\tret\n");
+
+// short is passed in the low 16 bits of a register or a stack slot.
+int short_sum(short a, short b, short c, short d, short e, short f, short g) {
+    return a + b + c + d + e + f + g;
+}
@@ -0,0 +1,6 @@
+// A scalar element must not be enclosed in extra braces.
+
+int main() {
+    int a[2] = {{1}, 2};
+    return a[0];
+}
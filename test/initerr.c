@@ -0,0 +1,6 @@
+// Too many elements in an aggregate initializer is an error.
+
+int main() {
+    struct { int a; int b[2]; } s = {1, {2, 3, 4}};
+    return s.a;
+}
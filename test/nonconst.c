@@ -0,0 +1,7 @@
+// An array size must be a constant expression.
+
+int main() {
+    int n = 3;
+    int ary[((1+n)*2)];
+    return 0;
+}
@@ -0,0 +1,7 @@
+// main returns 0 when control reaches its closing brace.
+
+int dirty() { return 42; }
+
+int main() {
+    dirty();
+}
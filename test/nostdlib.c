@@ -0,0 +1,12 @@
+// Runs without libc. The exit status is main's return value.
+
+int sum(int n) {
+    int x = 0;
+    for (int i = 1; i <= n; i++)
+        x = x + i;
+    return x;
+}
+
+int main() {
+    return sum(8) + 6;
+}
@@ -0,0 +1,23 @@
+// With -fomit-frame-pointer, locals are addressed relative to rsp.
+
+int sum(int *a, int n) {
+    int s = 0;
+    for (int i = 0; i < n; i++)
+        s = s + a[i];
+    return s;
+}
+
+int fib(int n) {
+    if (n < 2)
+        return n;
+    return fib(n - 1) + fib(n - 2);
+}
+
+int main() {
+    int a[5];
+    for (int i = 0; i < 5; i++)
+        a[i] = i * 3;
+    if (sum(a, 5) != 30)
+        return 1;
+    return fib(10) != 55;
+}
@@ -0,0 +1,4 @@
+#pragma once
+
+int once_val;
+int once_fn() { return 5; }
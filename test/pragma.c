@@ -0,0 +1,11 @@
+// A header guarded by `#pragma once` is included only once.
+// Unknown pragmas are ignored.
+
+#include "test/once.h"
+#include "test/../test/once.h"
+#pragma GCC diagnostic ignored "-Wall"
+#pragma
+
+int main() {
+    return once_fn() != 5;
+}
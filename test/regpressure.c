@@ -0,0 +1,10 @@
+// Needs 8 registers, which is possible without spilling only when
+// rbp is allocatable under -fomit-frame-pointer.
+
+int f(int a, int b, int c, int d, int e, int g) {
+    return a * (b * (c * (d * (e * (g * (a + 1))))));
+}
+
+int main() {
+    return f(1, 1, 1, 1, 1, 2) != 4;
+}
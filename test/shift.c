@@ -0,0 +1,5 @@
+// A shift by a constant count uses an immediate operand
+// instead of the cl register.
+
+int shl3(int x) { return x << 3; }
+int shr2(int x) { return x >> 2; }
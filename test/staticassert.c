@@ -0,0 +1,8 @@
+// A false static assertion is an error.
+
+_Static_assert(sizeof(int) == 4, "int is 4 bytes");
+
+int main() {
+    _Static_assert(sizeof(long) == 4, "long is 4 bytes");
+    return 0;
+}
@@ -0,0 +1,25 @@
+// With -O1, multiplication and division by powers of two are shifts.
+
+int times8(int x) { return x * 8; }
+int quot4(int x) { return x / 4; }
+long lquot8(long x) { return x / 8; }
+long diff(int *p, int *q) { return p - q; }
+long cdiff(char *p, char *q) { return p - q; }
+
+int main() {
+    if (times8(3) != 24) return 1;
+    if (times8(-3) != -24) return 2;
+    if (quot4(7) != 1) return 3;
+    if (quot4(-7) != -1) return 4;
+    if (quot4(-8) != -2) return 5;
+    if (lquot8(-9) != -1) return 6;
+    if (lquot8(17) != 2) return 7;
+    int a[10];
+    if (diff(a + 7, a + 2) != 5) return 8;
+    if (diff(a + 2, a + 7) != -5) return 9;
+    char s[4];
+    if (cdiff(s + 3, s + 1) != 2) return 10;
+    int y = 100;
+    y /= 16;
+    return y != 6;
+}
@@ -22,15 +22,88 @@ int two() { return 2; }
 int plus(int x, int y) { return x + y; }
 int mul(int x, int y) { return x * y; }
 int add(int a, int b, int c, int d, int e, int f) { return a+b+c+d+e+f; }
+int add8(int a, int b, int c, int d, int e, int f, int g, int h) { return a+b+c+d+e+f+g+h; }
+int sub7(int a, int b, int c, int d, int e, int f, int g) { return g-a; }
+int third9(int a, int b, int c, int d, int e, int f, char g, long h, int i) { return i*100+h*10+g; }
 int add2(int (*a)[2]) { return a[0][0] + a[1][0]; }
 int add3(int a[][2]) { return a[0][0] + a[1][0]; }
 int add4(int a[2][2]) { return a[0][0] + a[1][0]; }
+int param_size(int a[10]) { return sizeof(a); }
+int param_size2(int a[][3]) { return sizeof(a) * 100 + sizeof(a[0]); }
 void nop() {}
+int *elem(int *a, int i) { return a + i; }
+int logand(int a, int b) { return a && b; }
+int is_neg(long x) { return x < 0; }
+long lhalf(long x) { return x / 2; }
+int low_byte(char c) { return c; }
+int logor(int a, int b) { return a || b; }
+int logand53() { return 5 && 3; }
+int mixed_locals() {
+  char a = 1; int b = 20; char c = 3; int *p = &b; char d = 4; long e = 500; char *q = &c;
+  return a + b + c + *p + d + e + *q;
+}
+int logor00() { return 0 || 0; }
+
+int trap_if(int x) { if (x) __builtin_trap(); return 5; }
+int unreachable_if(int x) { if (x) return 3; __builtin_unreachable(); return 4; }
+
+int va_sum(int n, ...) {
+  char *ap;
+  __builtin_va_start(ap, n);
+  int sum = 0;
+  for (int i = 0; i < n; i++)
+    sum += __builtin_va_arg(ap, int);
+  return sum;
+}
+
+int va_sum6(int a, int b, int c, int d, int e, int n, ...) {
+  char *ap;
+  __builtin_va_start(ap, n);
+  int sum = a + b + c + d + e;
+  for (int i = 0; i < n; i++)
+    sum += __builtin_va_arg(ap, int);
+  return sum;
+}
+
+int switch_cnt;
+int switch_inc() { switch_cnt++; return switch_cnt; }
 
 int var1;
 int var2[5];
 extern int global_arr[1];
+long weighted8();
+int call_add8();
+int rsp_misalign();
+int rbx_preserved();
+int clobber_scratch();
+int short_sum();
+short neg_short(short a, short b, short c, short d, short e, short f, short g) { return -g; }
+int uses_rbx() { int a=1; return a*(a+(a+1)); }
 typedef int myint;
+typedef int (*binop)(int, int);
+typedef int vec3[3];
+int param_myint(int myint) { return (myint) + 1; }
+int param_sizeof(long myint) { int a[sizeof(myint)]; return sizeof(a); }
+char galign_pad;
+int galign __attribute__((aligned(16)));
+int gzero[8];
+int gsize[sizeof(long)];
+int gtab[3];
+int *gtab_p = gtab;
+int gint;
+int gm1, *gm2, gm3[3];
+typedef int tm1, *tm2;
+int gcount;
+int bump() { return ++gcount; }
+void set_gcount(int x) { if (x < 0) return; gcount = x; }
+_Static_assert(sizeof(int[3]) == 12, "int[3] is 12 bytes");
+int *gint_p = &gint;
+int ginit = 5;
+long glinit = 3000000000 * 2;
+char gcinit = 'a' + 1;
+short gsinit = -2;
+unsigned char guinit = 300;
+int (*gplus)(int, int) = plus;
 
 // Single-line comment test
 
@@ -67,6 +140,40 @@ int main() {
   EXPECT(3, one()+two());
   EXPECT(6, mul(2, 3));
   EXPECT(21, add(1,2,3,4,5,6));
+  EXPECT(36, add8(1,2,3,4,5,6,7,8));
+  EXPECT(6, sub7(1,2,3,4,5,6,7));
+  EXPECT(987, third9(0,0,0,0,0,0,7,8,9));
+  EXPECT(204, weighted8(1,2,3,4,5,6,7,8));
+  EXPECT(36, call_add8());
+  EXPECT(1, rbx_preserved());
+  EXPECT(8, one() + clobber_scratch());
+  EXPECT(10, one() + two() + clobber_scratch());
+  EXPECT(9, ({ int a = two(); int b = clobber_scratch(); a + b; }));
+  EXPECT(17, add(one(), two(), clobber_scratch(), one(), two(), clobber_scratch() - 3));
+  EXPECT(0, rsp_misalign());
+  EXPECT(0, rsp_misalign(1,2,3,4,5,6,7));
+  EXPECT(0, rsp_misalign(1,2,3,4,5,6,7,8));
+  EXPECT(0, add(1,2,3,4,5,rsp_misalign(1,2,3,4,5,6,7)) - 15);
+  EXPECT(36, add8(1,2,3,4,5,6,7,add(1,1,1,1,2,2)));
+  EXPECT(8, ({ int a[10]; param_size(a); }));
+  EXPECT(40, ({ int a[10]; sizeof(a); }));
+  EXPECT(812, ({ int a[2][3]; param_size2(a); }));
+  EXPECT(1, is_neg(1 << 31));
+  EXPECT(1, is_neg(-1));
+  EXPECT(-3, lhalf(-6));
+  EXPECT(-1073741824, lhalf(1 << 31));
+  EXPECT(-1, low_byte(255));
+  EXPECT(0x34, low_byte(0x1234));
+  EXPECT(7, ({ int x[3]; x[0]=3; x[1]=5; x[2]=7; *elem(x, 2); }));
+  EXPECT(5, ({ int x[3]; x[0]=3; x[1]=5; x[2]=7; elem(x, 0)[1]; }));
+  EXPECT(5, ({ int x[3]; x[0]=3; x[1]=5; x[2]=7; *(elem(x, 2) - 1); }));
+  EXPECT(9, ({ int x[3]; x[0]=3; x[1]=5; x[2]=7; *elem(x, 1) = 9; x[1]; }));
+
+  EXPECT(15, va_sum(5, 1, 2, 3, 4, 5));
+  EXPECT(0, va_sum(0));
+  EXPECT(36, va_sum(8, 1, 2, 3, 4, 5, 6, 7, 8));
+  EXPECT(55, va_sum(10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10));
+  EXPECT(30, va_sum6(1, 2, 3, 4, 5, 3, 4, 5, 6));
 
   EXPECT(0, 0 || 0);
   EXPECT(1, 1 || 0);
@@ -78,6 +185,15 @@ int main() {
   EXPECT(0, 0 && 1);
   EXPECT(1, 1 && 1);
 
+  EXPECT(1, logand53());
+  EXPECT(0, logor00());
+  EXPECT(1, logand(5, 3));
+  EXPECT(0, logand(5, 0));
+  EXPECT(0, logand(0, 7));
+  EXPECT(1, logor(0, -4));
+  EXPECT(1, logor(9, 0));
+  EXPECT(0, logor(0, 0));
+
   EXPECT(0, 0 < 0);
   EXPECT(0, 1 < 0);
   EXPECT(1, 0 < 1);
@@ -99,26 +215,95 @@ int main() {
   EXPECT(1, 6 >= 5);
 
   EXPECT(8, 1 << 3);
+  EXPECT(4, ({ long x=1; (x << 40) >> 38; }));
+  EXPECT(1, ({ long x=1; int n=40; (x << n) == 1099511627776; }));
+  EXPECT(8, ({ long x=1; sizeof(x << 1); }));
+  EXPECT(4, ({ long n=1; sizeof(1 << n); }));
+  EXPECT(4, ({ char c=1; sizeof(c << 1); }));
+  EXPECT(256, ({ char c=1; c << 8; }));
   EXPECT(4, 16 >> 2);
+  EXPECT(16, 1 << 4);
+  EXPECT(8, 1 + 1 << 2);
+  EXPECT(1, 1 << 2 < 5);
+  EXPECT(0, 1 << 3 < 5);
+  EXPECT(-4, -16 >> 2);
+  EXPECT(1, (-16 >> 2) == -4);
+  EXPECT(-2, ({ int x=-16; x >>= 3; x; }));
+  EXPECT(-8, ({ int x=-64; int n=3; x >> n; }));
+  EXPECT(1, ({ long x=0-1099511627776; int n=38; (x >> n) == -4; }));
+
+  EXPECT(-3, ({ int x=-7; return x/2; }));
+  EXPECT(3, ({ int x=-7; return x/-2; }));
+  EXPECT(-1, ({ int x=-7; return x%2; }));
+  EXPECT(-3, ({ long x=-7; return x/2; }));
+  EXPECT(-1, ({ long x=-7; return x%2; }));
+  EXPECT(1, ({ long x=0-3000000000; return x/1000000000 == -3; }));
+  EXPECT(1, ({ long x=0-3000000001; return x%1000000000 == -1; }));
 
   EXPECT(4, 19 % 5);
   EXPECT(0, 9 % 3);
+  EXPECT(2, 17 % 5);
+  EXPECT(-2, -17 % 5);
+  EXPECT(2, 17 % -5);
+  EXPECT(3, ({ long x=10000000003; x % 10; }));
+  EXPECT(1, ({ int x=17; x %= 4; x; }));
 
   EXPECT(0-3, -3);
     
   EXPECT(0, !1);
   EXPECT(1, !0);
+  EXPECT(3, -5 + 8);
+  EXPECT(3, - -3);
+  EXPECT(-6, -2 * 3);
+  EXPECT(1, ({ long x=5000000000; -x == 0-5000000000; }));
+  EXPECT(1, !!5);
+  EXPECT(0, !!0);
+  EXPECT(1, ({ int *p=0; !p; }));
+  EXPECT(0, ({ int x; int *p=&x; !p; }));
+  EXPECT(1, 1 != !1);
+  EXPECT(0, !1 != 0);
 
   EXPECT(-1, ~0);
   EXPECT(-4, ~3);
+  EXPECT(22, ({ int a=2; a*(a+(a+(a+(a+(a+1))))); }));
+  EXPECT(13, ({ int a=1; a+(a+(a+(a+(a+(a+(a+(a+(a+(a+(a+(a+1))))))))))); }));
+  EXPECT(44, ({ int a=2; a*(a+(a+(a+(a+(a+(a+(plus(a, a)+(a&&a)+(a+({ a+1; }))))))))); }));
+  EXPECT(5, ~~5);
+  EXPECT(1, ({ long x=~0; x == -1; }));
+  EXPECT(1, ({ long x=1; x <<= 40; ~x == -1099511627777; }));
+  EXPECT(4, ~3 & 6);
+  EXPECT(3, 1 | 2 ^ 3 & 1);
+  EXPECT(7, 1 ^ 7 & 2 | 4);
+  EXPECT(1, 5 & 3 == 3);
 
   EXPECT(3, ({ int i = 3; return i++;}));
   EXPECT(4, ({ int i = 3; return ++i;}));
   EXPECT(3, ({ int i = 3; return i--;}));
   EXPECT(2, ({ int i = 3; return --i;}));
+  EXPECT(4, ({ int i = 3; i++; i; }));
+  EXPECT(2, ({ int i = 3; i--; i; }));
+  EXPECT(45, ({ int s=0; int i=0; while (i<10) { s += i++; } s; }));
+  EXPECT(55, ({ int s=0; int i=0; while (i<10) { s += ++i; } s; }));
+  EXPECT(10, ({ int n=0; for (int i=0; i<10; ++i) n++; n; }));
+  EXPECT(0, ({ int n=10; for (int i=0; i<10; i++) --n; n; }));
+  EXPECT(3, ({ long a[3] = {1,2,3}; long *p=a; p++; p++; *p; }));
+  EXPECT(1, ({ long a[3] = {1,2,3}; long *p=a+2; --p; --p; *p; }));
+  EXPECT(1, ({ long a[3]; long *p=a; long *q=p++; q == a && p == a + 1; }));
 
   EXPECT(5, 0 ? 3 : 5);
   EXPECT(3, 1 ? 3 : 5);
+  EXPECT(3, 0 ? 1 : 0 ? 2 : 3);
+  EXPECT(10, ({ int a=0; int b=0; 1 ? a++ : b++; a*10+b; }));
+  EXPECT(1, ({ int a=0; int b=0; 0 ? a++ : b++; a*10+b; }));
+  EXPECT(8, ({ int x=3; (x > 2 ? x : -x) + 5; }));
+  EXPECT(12, ({ long x=3; (x > 5 ? x : x * 4); }));
+  EXPECT(7, ({ int a=0; int b=1; a = b ? 7 : 9; a; }));
+  EXPECT(9, ({ int a=0; int b=0; a = b ? 7 : 9; a; }));
+  EXPECT(5, ({ int c=0; 1 ? c = 5 : 0; c; }));
+  EXPECT(4, 4 ?: 9);
+  EXPECT(9, 0 ?: 9);
+  EXPECT(1, ({ int i=0; (++i) ?: 5; i; }));
+  EXPECT(3, ({ int a[0 ?: 3]; sizeof(a) / sizeof(a[0]); }));
 
   EXPECT(3, (1, 2, 3));
 
@@ -139,12 +324,26 @@ int main() {
   EXPECT(1, ({ int i=1; for (int i = 5; i < 10; i++); return i;}));
   EXPECT(5, ({ int i=0; for (0; i < 10; i++) if (i==5) break; return i;}));
   EXPECT(10, ({ int i=0; for(;;) { i++; if (i==10) break;} return i;}));
+  EXPECT(10, ({ int i=0; int n=0; for (; i<10; i++) { if (i%2) continue; n++; } i+n-5; }));
+  EXPECT(25, ({ int n=0; for (int i=0; i<10; i++) { if (i%2==0) continue; n+=i; } n; }));
+  EXPECT(4, ({ int i=0; int n=0; do { i++; if (i<7) continue; n++; } while (i<10); n; }));
+  EXPECT(3, ({ int n=0; for (int i=0; i<3; i++) { switch (i) { case 1: continue; } n++; } n+1; }));
+  EXPECT(30, ({ int n=0; for (int i=0; i<3; i++) for (int j=0; j<100; j++) { if (j==10) break; n++; } n; }));
+  EXPECT(15, ({ int n=0; for (int i=0; i<3; i++) { for (int j=0; j<10; j++) { if (j%2) continue; n++; } } n; }));
+  EXPECT(6, ({ int n=0; int i=0; while (i<3) { i++; int j=0; do { j++; if (j==2) break; } while (1); n+=j; } n; }));
+  EXPECT(3, ({ int i=0; goto_a: i++; if (i<3) goto goto_a; i; }));
+  EXPECT(7, ({ int x=1; { int y=2; { int z=3; x=x+y+z; goto goto_b; } x=100; } goto_b: ; x+1; }));
+  EXPECT(12, ({ int n=0; for (int i=0; i<10; i++) for (int j=0; j<10; j++) { if (i*j==12) goto goto_c; n++; } goto_c: ; n-14; }));
+  EXPECT(5, ({ int x=5; goto goto_d; x=6; goto_d: ; x; }));
   EXPECT(45, ({ int i=0; int j=0; while(i<10) {j=j+i; i=i+1;} return j;}));
 
   EXPECT(3, ({ int ary[2]; *ary=1; *(ary+1)=2; return *ary + *(ary+1);}));
   EXPECT(5, ({ int x; int *p = &x; x = 5; return *p;}));
 
   EXPECT(40, ({ int ary[2][5]; return sizeof(ary);}));
+  EXPECT(80, ({ int ary[((2+3)*4)]; return sizeof(ary);}));
+  EXPECT(24, ({ char ary[(((((1+1))*((3)))))*(4)]; return sizeof(ary);}));
+  EXPECT(14, ({ enum { A=((1+(2*3))*2) }; return A;}));
   EXPECT(8, ({ int ary[2][2]; ary[0][0]=3; ary[1][0]=5; return add2(ary);}));
   EXPECT(8, ({ int ary[2][2]; ary[0][0]=3; ary[1][0]=5; return add3(ary);}));
   EXPECT(8, ({ int ary[2][2]; ary[0][0]=3; ary[1][0]=5; return add4(ary);}));
@@ -154,14 +353,103 @@ int main() {
   EXPECT(1, ({ int ary[2]; ary[0]=1; ary[1]=2; int *p=ary; return *p++;}));
   EXPECT(2, ({ int ary[2]; ary[0]=1; ary[1]=2; int *p=ary; return *++p;}));
 
+  EXPECT(3, ({ int x = 1 + \
+2; return x; }));
+  EXPECT(4, sizeof("ab\
+c"));
+  EXPECT(7, ({ int ab=7; return a\
+b; }));
+  EXPECT(12, 1\
+2);
+  EXPECT(255, 0x\
+f\
+f);
+  EXPECT(5, ({ int x=5; ret\
+urn x; }));
+
+  EXPECT(3, ({ int ary[4]; int *p=ary; int *q=ary+3; return q-p; }));
+  EXPECT(1, ({ int ary[4]; int *p=ary; int *q=ary+3; return p-q < 0; }));
+  EXPECT(1, ({ int ary[4]; int *p=ary; int *q=ary+3; return p-q == -3; }));
+  EXPECT(1, ({ char ary[4]; char *p=ary; char *q=ary+2; int n=-1; return p-q < n; }));
+  EXPECT(1, ({ int ary[4]; int *p=ary; int *q=ary+3; int n=-3; return p-q == n; }));
+  EXPECT(8, ({ int *p; int *q; return sizeof(p-q); }));
+
   EXPECT(1, ({ char x; return sizeof x; }));
   EXPECT(4, ({ int x; return sizeof(x); }));
   EXPECT(8, ({ int *x; return sizeof x; }));
   EXPECT(16, ({ int x[4]; return sizeof x; }));
+  EXPECT(1, sizeof(char));
+  EXPECT(44, (char)300);
+  EXPECT(-56, ({ int x=200; (char)x; }));
+  EXPECT(1, (short)65537);
+  EXPECT(-1, (long)-1);
+  EXPECT(8, sizeof((long)1));
+  EXPECT(1, sizeof((char)1));
+  EXPECT(4, ({ int x=0x01020304; *(char *)&x; }));
+  EXPECT(3, (long)((char *)0 + 3));
+  EXPECT(12, (long)((int *)0 + 3));
+  EXPECT(5, ({ int x=5; (void)x; x; }));
+  EXPECT(2, ({ typedef short S; (S)65538; }));
+  EXPECT(4, ({ typedef int T; int T=3; (T)+1; }));
+  EXPECT(6, param_myint(5));
+  EXPECT(32, param_sizeof(0));
+  EXPECT(8, ({ int a[(char)258]; sizeof(a); }));
+  EXPECT(-2, -(char)2);
+  EXPECT(0, (char)256 + (char)-256);
+  EXPECT(2, sizeof(short));
+  EXPECT(2, sizeof(short int));
+  EXPECT(-3, ({ short s=-3; s; }));
+  EXPECT(1, ({ short s=65537; s; }));
+  EXPECT(-32768, ({ short s=32767; s=s+1; s; }));
+  EXPECT(4, ({ short a[3]; a[0]=1; a[1]=-1; a[2]=3; a[0]+a[2]; }));
+  EXPECT(-1, ({ short a[3]; a[0]=1; a[1]=-1; a[2]=3; a[1]; }));
+  EXPECT(6, ({ int x=0; short *p=&x; p[1]=6; x>>16; }));
+  EXPECT(4, sizeof(struct { char c; short s; }));
+  EXPECT(2, ({ struct { char c; short s; } x; char *p=&x; char *q=&x.s; q-p; }));
+  EXPECT(-7, short_sum(1, 2, 3, 4, 5, 6, -28));
+  EXPECT(7, neg_short(0, 0, 0, 0, 0, 0, -7));
+  EXPECT(3, ({ struct { short a:3; short b:5; } x; x.a=3; x.b=-1; x.a; }));
+  EXPECT(8, sizeof(gsize) / sizeof(gsize[0]));
+  EXPECT(12, ({ int a[sizeof(int) * 3]; sizeof(a) / sizeof(a[0]); }));
+  EXPECT(16, ({ long x; char a[sizeof(x) * 2]; sizeof(a); }));
+  EXPECT(3, ({ char s[3]; int a[sizeof(s)]; sizeof(a) / sizeof(a[0]); }));
+  EXPECT(5, ({ char *p; char a[sizeof(*p) + sizeof("abc")]; sizeof(a); }));
+  EXPECT(300, ({ char a=100; char b=100; char c=100; a+b+c; }));
+  EXPECT(150, ({ char a=100; char b=100; char c=100; (a+b+c)/2; }));
+  EXPECT(44, ({ char a=100; char b=100; char c=100; a = a+b+c; a; }));
+  EXPECT(4, ({ char a=1; char b=2; sizeof(a+b); }));
+  EXPECT(4, ({ char a=1; sizeof(-a); }));
+  EXPECT(8, ({ char a=1; long b=2; sizeof(a*b); }));
+  EXPECT(4, ({ long a=1; long b=2; sizeof(a<b); }));
+  EXPECT(4, sizeof(int));
+  EXPECT(8, sizeof(long));
+  EXPECT(8, sizeof(long int));
+  EXPECT(8, _Alignof(long));
+  EXPECT(0, ({ char c; long x; (long)&x % 8; }));
+  EXPECT(8, sizeof(4294967296));
+  EXPECT(2, 4294967296 / 2147483648);
+  EXPECT(551, mixed_locals());
+  EXPECT(1534, ({ char a=1; int b=2; char c=3; int *p=&b; char d=4; *p=5; a*1000+b*100+c*10+d; }));
+  EXPECT(4, sizeof(2147483647));
+  EXPECT(8, sizeof(2147483648));
+  EXPECT(8, sizeof(0x100000000));
+  EXPECT(1500000000, 3000000000 / 2);
+  EXPECT(-3, -3000000000 / 1000000000);
+  EXPECT(1, ({ long x = 4000000000; x > 3000000000; }));
+  EXPECT(2, ({ int a[4]; long d = &a[3] - &a[1]; d; }));
+  EXPECT(8, sizeof(int *));
+  EXPECT(12, sizeof(int[3]));
+  EXPECT(24, sizeof(int[2][3]));
+  EXPECT(16, sizeof(char *[2]));
+  EXPECT(4, _Alignof(int[3]));
   EXPECT(4, sizeof("abc"));
   EXPECT(7, sizeof("abc" "def"));
   EXPECT(9, sizeof("ab\0c" "\0def"));
 
+  EXPECT(8, ({ int (*fp)(int, int); return sizeof(fp); }));
+  EXPECT(8, ({ int (*fp)(void); return sizeof fp; }));
+  EXPECT(8, ({ int (*fp)(int x, char *y); fp = plus; return sizeof(fp); }));
+
   EXPECT(1, ({ char x; return _Alignof x;}));
   EXPECT(4, ({ int x; return _Alignof x;}));
   EXPECT(8, ({ int *x; return _Alignof x;}));
@@ -171,21 +459,59 @@ int main() {
 
   EXPECT(5, ({ char x = 5; return x; }));
   EXPECT(42, ({ int x = 0; char *p = &x; p[0] = 42; return x; }));
+  EXPECT(1, ({ int *p = 0; p == 0; }));
+  EXPECT(0, ({ int x; int *p = &x; p == 0; }));
+  EXPECT(1, ({ int x; int *p = &x; p = 0; !p && 0 == p; }));
+  EXPECT(4, ({ int *p = 0; sizeof(p == 0) + sizeof(0 + 0) - 4; }));
   
 
+  EXPECT(65, 'A');
+  EXPECT(0, '\0');
+  EXPECT(10, '\n');
+  EXPECT(9, '\t');
+  EXPECT(92, '\\');
+  EXPECT(39, '\'');
+  EXPECT(65, '\101');
+  EXPECT(0, ({ char *p = "a\0b"; p[1]; }));
+  EXPECT(98, ({ char *p = "a\0b"; p[2]; }));
   EXPECT('a', ({ char *p = "abc"; return p[0]; }));
   EXPECT('b', ({ char *p = "abc"; return p[1]; }));
   EXPECT('c', ({ char *p = "abc"; return p[2]; }));
   EXPECT(0, ({ char *p = "abc"; return p[3]; }));
+  EXPECT('l', ({ char *p = "hello"; *(p+3); }));
+  EXPECT('o', ({ char *p = "hello"; p = p + 4; *p; }));
+  EXPECT(5, ({ char *p = "hello"; int n = 0; while (*p) { p++; n++; } n; }));
+  EXPECT('e', ({ char *p = "hello"; p += 2; p -= 1; *p; }));
+
+  EXPECT('c', ({ char s[4] = "abc"; s[2]; }));
+  EXPECT(0, ({ char s[4] = "abc"; s[3]; }));
+  EXPECT(0, ({ char s[8] = "ab"; s[2] + s[7]; }));
+  EXPECT(294, ({ char s[3] = "abc"; s[0] + s[1] + s[2]; }));
+  EXPECT(3, ({ char s[3] = "abc"; sizeof(s); }));
+  EXPECT('d', ({ char a[2][3] = {"abc", "de"}; a[1][0]; }));
+  EXPECT('c', ({ char a[2][3] = {"abc", "de"}; a[0][2]; }));
+  EXPECT(0, ({ char a[2][3] = {"abc", "de"}; a[1][2]; }));
+  EXPECT('z', ({ struct { char s[3]; char c; } x = {"abc", 'z'}; x.c; }));
+  EXPECT('b', ({ struct { char s[3]; char c; } x = {"abc", 'z'}; x.s[1]; }));
+  EXPECT(1, ({ char s[2] = "\n"; s[0] == 10 && s[1] == 0; }));
+  EXPECT(3, ({ char *p = "hello"; char *q = p + 3; q - p; }));
 
   EXPECT(1, ({ int x = 1; { int x = 2; } return x; }));
 
+  EXPECT(0, ({ char c; int x __attribute__((aligned(16))); char *p=&x; char *z=0; return (p-z)%16; }));
+  EXPECT(0, ({ char c; char x[3] __attribute__((aligned(8))); char *z=0; return (x-z)%8; }));
+  EXPECT(16, ({ int x __attribute__((aligned(16))); return _Alignof(x); }));
+  EXPECT(0, ({ char *p=&galign; char *z=0; return (p-z)%16; }));
+
   EXPECT(0, var1);
   EXPECT(5, ({ var1 = 5; return var1; }));
   EXPECT(20, sizeof(var2));
   EXPECT(15, ({ var2[0] = 5; var2[4] = 10; return var2[0] + var2[4]; }));
   EXPECT(5, global_arr[0]);
 
+  EXPECT(5, trap_if(0));
+  EXPECT(3, unreachable_if(1));
+
   EXPECT(8, ({ return 3 + ({ return 5; }); }));
   EXPECT(1, ({; return 1;}));
 
@@ -210,16 +536,227 @@ int main() {
       return x.a[0].b + x.a[0].c[1];
   }));
 
+  EXPECT(5, ({ int x=0; switch(3) { case 2: x=2; break; case 3: x=5; break; } return x; }));
+  EXPECT(7, ({ int x=0; switch(3) { case 3: x=5; case 4: x=7; break; } return x; }));
+  EXPECT(9, ({ int x=0; switch(4) { case 3: x=5; break; default: x=9; } return x; }));
+  EXPECT(0, ({ int x=0; switch(4) { case 3: x=5; break; } return x; }));
+  EXPECT(6, ({ int x=0; switch(2) { case 1+1: x=6; break; case 3: x=7; break; } return x; }));
+  EXPECT(8, ({ int x=0; switch(-1) { case 2*3-7: x=8; break; case 1<<2: x=9; break; } return x; }));
+  EXPECT(2, ({ enum { RED, GREEN, BLUE } c=GREEN; int x=0; switch(c) { case RED: x=1; break; case GREEN: x=2; break; case BLUE: x=3; break; } return x; }));
+  EXPECT(6, ({ enum color { RED=5, GREEN }; int x=0; switch(6) { case RED: x=5; break; case GREEN: x=6; break; } return x; }));
+  EXPECT(11, ({ enum { X=10, Y }; return Y; }));
+  EXPECT(7, ({ enum { P=3, Q=P*2, R }; return R; }));
+  EXPECT(-1, ({ enum { N=-2, M }; return M; }));
+  EXPECT(123, ({ enum { E0, E1, E2=10, E3, E4=0, E5 }; return E1*100 + E3*2 + E5 - E4; }));
+  EXPECT(6, ({ enum fruit { APPLE=5, PEAR }; enum fruit f = PEAR; return f; }));
+  EXPECT(4, ({ enum fruit { APPLE }; enum fruit f; return sizeof(f); }));
+  EXPECT(3, ({ enum { K=1 }; int x = K; { enum { K=2 }; x += K; } return x; }));
+  EXPECT(2, ({ enum { K=1 }; int x = K; { enum { K=2 }; } return x + K; }));
+  EXPECT(3, ({ enum { K=5 }; int x; { int K = 3; x = K; } x; }));
+  EXPECT(8, ({ enum { K=5 }; int x; { int K = 3; x = K; } x + K; }));
+  EXPECT(5, ({ int K = 3; int x; { enum { K=5 }; x = K; } x; }));
+  EXPECT(12, ({ int x=0; switch(5) { case 1: x=1; default: x+=10; case 2: x+=2; } return x; }));
+  EXPECT(2, ({ int x=0; switch(2) { case 1: x=1; default: x+=10; case 2: x+=2; } return x; }));
+  EXPECT(23, ({ int x=0; switch(1) { case 1: switch(2) { case 2: x=20; break; case 3: x=30; } x+=3; break; case 2: x=9; } return x; }));
+  EXPECT(4, ({ int x=0; switch(1) { case 1: for (;;) { x++; if (x==3) break; } x++; break; case 2: x=9; } return x; }));
+  EXPECT(3, ({ long x=5000000000; int y=0; switch(x) { case 1: y=1; break; default: y=3; } return y; }));
+  EXPECT(1, ({ switch_cnt=0; switch (switch_inc()) { case 3: break; case 2: break; case 1: break; } return switch_cnt; }));
+
+  EXPECT(7, ({ struct { int a; int b; } x[2]; x[1].a=3; x[1].b=4; return x[1].a+x[1].b; }));
+  EXPECT(6, ({ struct { int a; int b; } x[2]; (*(x+1)).a=2; x[0].b=4; return (*(x+1)).a+(*x).b; }));
+  EXPECT(9, ({ struct { char a; int b; } x[3]; x[2].b=9; return (*(x+2)).b; }));
+
+  EXPECT(5, ({ struct { char a; int b; } __attribute__((packed)) x; return sizeof(x); }));
+  EXPECT(1, ({ struct { char a; int b; } __attribute__((packed)) x; return _Alignof(x); }));
+  EXPECT(1, ({ struct { char a; int b; } __attribute__((packed)) x; char *p=&x; char *q=&x.b; return q-p; }));
+  EXPECT(306, ({ struct __attribute__((packed)) { char a; int b; char c; } x; x.a=1; x.b=300; x.c=2; return sizeof(x)+x.b; }));
   EXPECT(3, ({ typedef int foo; foo x = 3; return x;}));
   EXPECT(4, ({ myint foo = 3; return sizeof(foo);}));
+  EXPECT(1, ({ typedef char myint; sizeof(myint); }));
+  EXPECT(4, ({ { typedef char myint; } sizeof(myint); }));
+  EXPECT(5, ({ typedef long T; { typedef char T; } sizeof(T) - 3; }));
+  EXPECT(3, ({ int myint = 3; myint; }));
+  EXPECT(4, ({ { int myint = 3; } myint x; sizeof(x); }));
+  EXPECT(4, ({ for (int myint = 0; myint < 3; myint++) ; myint x; sizeof(x); }));
+  EXPECT(5, ({ typedef int *P; int x=5; P p=&x; *p; }));
+
+  EXPECT(1, ({ int a = 1, *p = &a, c[3]; *p; }));
+  EXPECT(12, ({ int a = 1, *p = &a, c[3]; sizeof(c); }));
+  EXPECT(8, ({ int a = 1, *p = &a, c[3]; sizeof(p); }));
+  EXPECT(7, ({ int a = 1, *p = &a, c[3]; c[2] = 6; *p + c[2]; }));
+  EXPECT(3, ({ int a = 1, b = a + 1; a + b; }));
+  EXPECT(5, ({ int s=0; for (int i=0, j=10; i<j; i++, j--) s++; s; }));
+  EXPECT(7, ({ gm1 = 3; gm2 = &gm1; gm3[2] = 4; *gm2 + gm3[2]; }));
+  EXPECT(12, sizeof(gm3));
+  EXPECT(5, ({ int x = 5; tm2 p = &x; tm1 y = *p; y; }));
+  EXPECT(5, ({ typedef char C, D[4]; sizeof(C) + sizeof(D); }));
+
+  EXPECT(7, ({ set_gcount(7); gcount; }));
+  EXPECT(7, ({ set_gcount(7); set_gcount(-1); gcount; }));
+  EXPECT(1, sizeof(void));
+  EXPECT(8, sizeof(void *));
+  EXPECT(3, ({ char a[4]; void *p=a; void *q=p+3; char *r=q; r-a; }));
+  EXPECT(5, ({ int x=5; void *p=&x; int *q=p; *q; }));
 
   EXPECT(1, ({ typedef struct foo_ foo; return 1;}));
+  EXPECT(0, ({ gcount=0; 1 ? 0 : bump(); gcount; }));
+  EXPECT(0, ({ gcount=0; 0 ? gcount++ : 5; gcount; }));
+  EXPECT(1, ({ gcount=0; 0 ? gcount++ : bump(); gcount; }));
+  EXPECT(12, ({ int a=1; int b=2; int x = a>b ? (a=10) : (b=12); a+b-1; }));
+  EXPECT(45, ({ int s=0; for (int i=0; i<10; i++) s += i%2 ? (i%3 ? i : i) : (i%5 ? i : i); s; }));
+  EXPECT(3, ({ int i=0; for (;;) { if (i==3) break; i++; } i; }));
+  EXPECT(7, ({ 3; 7; }));
+  EXPECT(2, ({ int i=0; for (; i<10; i++) { ({ if (i==2) break; 0; }); } i; }));
+  EXPECT(5, ({ int i=0; while (1) { int x = ({ int j=i; j*2; }); if (x>8) break; i++; } i; }));
+  EXPECT(8, ({ long x = 1; x << 3; }) + sizeof(({ long y = 1; y; })) - 8);
+  EXPECT(3, ({ struct { int a; int b[2]; } s = {1, {2, 3}}; return s.b[1]; }));
+  EXPECT(6, ({ struct { int a; int b[2]; } s = {1, {2, 3}}; return s.a+s.b[0]+s.b[1]; }));
+  EXPECT(6, ({ struct { int a; int b[2]; } s = {1, 2, 3}; return s.a+s.b[0]+s.b[1]; }));
+  EXPECT(0, ({ struct { int a; int b[2]; } s = {1, {2}}; return s.b[1]; }));
+  EXPECT(0, ({ struct { int a; int b[2]; } s = {}; return s.a+s.b[0]+s.b[1]; }));
+  EXPECT(5, ({ int a[2][3] = {{1, 2}, {3}}; return a[0][0]+a[0][1]+a[0][2]+a[1][0]+a[1][2]-1; }));
+  EXPECT(21, ({ int a[2][3] = {1, 2, 3, 4, 5, 6,}; return a[0][0]+a[0][1]+a[0][2]+a[1][0]+a[1][1]+a[1][2]; }));
+  EXPECT(6, ({ int a[3] = {1, 2, 3}; a[0]+a[1]+a[2]; }));
+  EXPECT(0, ({ int a[5] = {1, 2}; a[2]+a[3]+a[4]; }));
+  EXPECT(12, ({ int a[] = {1, 2, 3}; sizeof(a); }));
+  EXPECT(3, ({ int a[] = {1, 2, 3,}; a[2]; }));
+  EXPECT(4, ({ char s[] = "abc"; sizeof(s); }));
+  EXPECT(0, ({ char s[] = "abc"; s[3]; }));
+  EXPECT(3, ({ char s[] = "hi"; sizeof(s); }));
+  EXPECT(1, ({ char s[] = ""; sizeof(s); }));
+  EXPECT(0, ({ char s[] = ""; s[0]; }));
+  EXPECT(3, ({ char s[] = "a\tb"; s[1] == 9 ? 3 : 0; }));
+  EXPECT(5, ({ char s[] = "hello"; int n = 0; for (char *p = s; *p; p++) n++; n; }));
+  EXPECT('j', ({ char s[] = "hi"; s[0] = 'j'; s[0]; }));
+  EXPECT('h', ({ char s[] = "hi"; s[0] = 'j'; char *t = "hi"; t[0]; }));
+  EXPECT(16, ({ int a[][2] = {1, 2, 3}; sizeof(a); }));
+  EXPECT(16, ({ int a[][2] = {{1, 2}, {3}}; sizeof(a); }));
+  EXPECT(3, ({ int a[][2] = {{1, 2}, {3}}; a[1][0]; }));
+  EXPECT(12, ({ char a[][4] = {"ab", "cd", "e"}; sizeof(a); }));
+  EXPECT(16, ({ struct { int x; char c; } a[] = {1, 2, 3}; sizeof(a); }));
+  EXPECT(7, ({ struct { char c; struct { int x; int y; } p[2]; } s = {1, {{2, 3}, {4}}}; return s.c+s.p[0].x+s.p[1].x+s.p[1].y; }));
+  EXPECT(4, ({ int x = {4}; return x; }));
+  EXPECT(8, sizeof(long long));
+  EXPECT(8, sizeof(long long int));
+  EXPECT(8, sizeof(unsigned long long));
+  EXPECT(8, ({ long long x; return sizeof(x); }));
+  EXPECT(1, ({ long long x = 1; x = x << 40; return x == 1099511627776; }));
+  EXPECT(3, ({ long long x = 3000000000; x = x * 4; return x / 4000000000; }));
+  EXPECT(1, ({ unsigned long long x = 1; x <<= 33; return (x >> 33); }));
+  EXPECT(4, sizeof(unsigned));
+  EXPECT(4, sizeof(unsigned int));
+  EXPECT(1, sizeof(unsigned char));
+  EXPECT(2, sizeof(unsigned short int));
+  EXPECT(8, sizeof(unsigned long));
+  EXPECT(0, ({ int unsigned x = 1; x > -1; }));
+  EXPECT(0, ({ long unsigned x = 1; x > -1; }));
+  EXPECT(8, sizeof(long unsigned int));
+  EXPECT(8, sizeof(long int unsigned long));
+  EXPECT(2, sizeof(short unsigned));
+  EXPECT(1, ({ signed x = 1; x > -1; }));
+  EXPECT(4, sizeof(signed));
+  EXPECT(-1, ({ signed char c = 255; c; }));
+  EXPECT(-1, ({ long signed x = -1; x; }));
+  EXPECT(2000000000, ({ unsigned x = 2000000000; x = x * 2; x / 2; }));
+  EXPECT(1705032704, ({ unsigned x = 2000000000; x = x + x + x; x; }));
+  EXPECT(1, ({ unsigned x = -1; x = x + 1; x == 0; }));
+  EXPECT(1, ({ unsigned x = 4000000000 - 1; x % 2; }));
+  EXPECT(255, ({ unsigned char c = -1; c; }));
+  EXPECT(0, ({ unsigned char c = 255; c + 1 == 0; }));
+  EXPECT(0, ({ unsigned char c = 255; c++; c; }));
+  EXPECT(255, ({ unsigned char c = 255; c++; }));
+  EXPECT(44, ({ unsigned char c = 200; c += 100; }));
+  EXPECT(65535, ({ unsigned short s = -1; s; }));
+  EXPECT(1, ({ unsigned x = -1; x > 0; }));
+  EXPECT(0, ({ int x = -1; x > 0; }));
+  EXPECT(1, ({ unsigned x = 1; int y = -1; y > x; }));
+  EXPECT(0, ({ long x = 1; int y = -1; y > x; }));
+  EXPECT(1, ({ unsigned x = -1; x == -1; }));
+  EXPECT(1, ({ unsigned long x = -1; x > 1; }));
+  EXPECT(1, ({ unsigned x = 3; int n = 0; if (x < -1) n = 1; n; }));
+  EXPECT(3, ({ unsigned x = 3; int n = 0; for (unsigned i = 5; i >= x; i--) n++; n; }));
+  EXPECT(1, (unsigned)-1 > 0);
+  EXPECT(1, (unsigned char)257);
+  EXPECT(255, (unsigned char)-1);
+  EXPECT(-1, (int)(unsigned)-1);
+  EXPECT(1, ({ unsigned x = -1; (long)x == 4294967295; }));
+  EXPECT(1, ({ unsigned x = -1; (unsigned long)x > 4294967294; }));
+  EXPECT(1, ({ int x = -1; (unsigned long)x > 4294967295; }));
+  EXPECT(1, ({ unsigned x = -1; -x; }));
+  EXPECT(1, ({ unsigned x = -2; x >> 31; }));
+  EXPECT(-1, ({ int x = -2; x >> 31; }));
+  EXPECT(2147483647, ({ unsigned x = -2; x >>= 1; x; }));
+  EXPECT(2147483647, ({ unsigned x = -1; x / 2; }));
+  EXPECT(7, ({ unsigned x = 15; x & ~8; }));
+  EXPECT(1, ({ unsigned x = -1; ~x == 0; }));
+  EXPECT(2147483644, ({ int x = -8; unsigned two = 2; x / two; }));
+  EXPECT(1, ({ unsigned long x = -1; x / 2 == 9223372036854775807; }));
+  EXPECT(7, ({ struct { unsigned a:3; } s; s.a = -1; s.a; }));
+  EXPECT(1, ({ unsigned a[2]; a[0] = -1; a[1] = 1; a[0] > a[1]; }));
+  EXPECT(30, ({ int x=3; int y=5; return x*y + x*y; }));
+  EXPECT(35, ({ int x=3; int y=5; return x*y + (x=4, x*y); }));
+  EXPECT(29, ({ int x=3; int *p=&x; return x*x + (*p=4, 0) + x*x + x; }));
+  EXPECT(25, ({ int x=3; return x*x + (x++, x*x); }));
+  EXPECT(3, ({ int x=3; _Static_assert(sizeof(int) == 4, "int"); _Static_assert(1+1, "nonzero"); return x; }));
+  EXPECT(5, ({ volatile int x=5; return x; }));
+  EXPECT(7, ({ int volatile x=3; x+=4; return x; }));
+  EXPECT(8, ({ int x=8; int *volatile p=&x; return *p; }));
+  EXPECT(4, ({ volatile char c[4]; return sizeof(c); }));
+  EXPECT(4, ({ struct { int a:3; int b:5; int c:10; } x; return sizeof(x); }));
+  EXPECT(8, ({ struct { int a:30; int b:5; } x; return sizeof(x); }));
+  EXPECT(8, ({ struct { char c; int a:3; int d; } x; return sizeof(x); }));
+  EXPECT(2, ({ struct { char a:4; char b:4; char c:4; } x; return sizeof(x); }));
+  EXPECT(3, ({ struct { int a:3; int b:5; } x; x.a=3; x.b=9; return x.a; }));
+  EXPECT(9, ({ struct { int a:3; int b:5; } x; x.a=3; x.b=9; return x.b; }));
+  EXPECT(-1, ({ struct { int a:3; int b:5; } x; x.a=7; x.b=2; return x.a; }));
+  EXPECT(1, ({ struct { int a:3; int b:5; } x; return x.a=9; }));
+  EXPECT(10, ({ struct { int a:3; int b:5; int c; } x; x.c=10; x.a=1; x.b=2; x.b+=x.a; x.a++; return x.a+x.b+x.c-5; }));
+  EXPECT(300, ({ struct { char a; int b:12; char c; } x; x.a=-1; x.b=300; x.c=-1; return x.b; }));
+  EXPECT(7, ({ gtab[1]=7; return gtab_p[1]; }));
+  EXPECT(9, ({ gint=9; return *gint_p; }));
+  EXPECT(5, ginit);
+  EXPECT(1, glinit == 6000000000);
+  EXPECT(98, gcinit);
+  EXPECT(-2, gsinit);
+  EXPECT(44, guinit);
+  EXPECT(1, ({ return gplus == plus; }));
+  EXPECT(32, ({ int x=0; for (int i=0; i<8; i++) x+=gzero[i]; return x+sizeof(gzero); }));
+  EXPECT(4, ({ struct { char a; int b; } x; return __builtin_offsetof(struct { char a; int b; }, b); }));
+
+  EXPECT(8, ({ union { int a; char b; long c; } x; sizeof(x); }));
+  EXPECT(4, ({ union { char a[3]; int b; } x; sizeof(x); }));
+  EXPECT(8, ({ union { char a[5]; int b; } x; sizeof(x); }));
+  EXPECT(0x78, ({ union { int a; char b; } x; x.a = 0x12345678; x.b; }));
+  EXPECT(0x34, ({ union { int a; char b[4]; } x; x.a = 0x12345678; x.b[2]; }));
+  EXPECT(0x1234ff, ({ union { int a; char b; } x; x.a = 0x123456; x.b = -1; x.a; }));
+  EXPECT(0, ({ union u { int a; char b; } x; __builtin_offsetof(union u, b); }));
+  EXPECT(7, ({ union { int a; long b; } x = { 7 }; x.a; }));
+  EXPECT(0, ({ struct off1 { char a; int b; } x; return __builtin_offsetof(struct off1, a); }));
+  EXPECT(8, ({ struct off2 { char a; struct { int x; int y; } in; } x; return __builtin_offsetof(struct off2, in.y); }));
+  EXPECT(8, ({ struct off3 { char a; long b; } x; return sizeof(__builtin_offsetof(struct off3, b)); }));
+  EXPECT(0, __builtin_offsetof(struct { char a; int b; }, b) > -1);
+  EXPECT(8, ({ struct off4 { int a; int b; int c; } x; int arr[__builtin_offsetof(struct off4, c)]; return sizeof(arr)/4; }));
+  EXPECT(1, ({ struct pt { int x; int y; } a; struct pt b; a.x=1; a.y=2; b.x=1; b.y=2; return __builtin_struct_eq(a, b); }));
+  EXPECT(0, ({ struct pt { int x; int y; } a; struct pt b; a.x=1; a.y=2; b.x=1; b.y=3; return __builtin_struct_eq(a, b); }));
+  EXPECT(1, ({ struct pt { int x; int y; } a[2]; struct pt *p=a; a[0].x=5; a[0].y=6; a[1].x=5; a[1].y=6; return __builtin_struct_eq(a[1], *p); }));
+  EXPECT(12, sizeof(vec3));
+  EXPECT(6, ({ vec3 v; v[0]=1; v[1]=2; v[2]=3; return v[0]+v[1]+v[2]; }));
+  EXPECT(8, ({ binop f; return sizeof(f); }));
+  EXPECT(1, ({ binop f = plus; return f == plus; }));
+  EXPECT(24, ({ typedef char name[8]; name a[3]; return sizeof(a); }));
+  EXPECT(8, ({ typedef int (*fp)(void); fp f; return sizeof(f); }));
 
   EXPECT(15, ({ int i=5; i*=3; return i;}));
   EXPECT(1, ({ int i=5; i/=3; return i;}));
   EXPECT(2, ({ int i=5; i%=3; return i;}));
   EXPECT(8, ({ int i=5; i+=3; return i;}));
   EXPECT(2, ({ int i=5; i-=3; return i;}));
+  EXPECT(3, ({ int a[4]={1,2,3,4}; int *p=a; p+=2; *p; }));
+  EXPECT(2, ({ int a[4]={1,2,3,4}; int *p=a+3; p-=2; *p; }));
+  EXPECT(3, ({ long a[3]={1,2,3}; long *p=a; p+=2; *p; }));
+  EXPECT(51, ({ int a[3]={0,0,0}; int i=0; a[i++]+=5; a[0]*10+i; }));
+  EXPECT(65, ({ int x=1; int y=2; x += y += 3; x*10+y; }));
+  EXPECT(30, ({ int x=1; (x += 2) * 10; }));
   EXPECT(40, ({ int i=5; i<<=3; return i;}));
   EXPECT(0, ({ int i=5; i>>=3; return i;}));
   EXPECT(1, ({ int i=5; i&=3; return i;}));
@@ -0,0 +1,9 @@
+// Every access to a volatile object must be a memory operation.
+
+int main() {
+    volatile int x = 3;
+    int sum = 0;
+    for (int i = 0; i < 2; i++)
+        sum = sum + x * x;
+    return sum - 18;
+}
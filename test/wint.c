@@ -0,0 +1,13 @@
+// An integer is not a pointer unless it is a null pointer constant.
+
+int main() {
+    int x;
+    int *p = 0;
+    int *q = 4;
+    p = 0;
+    if (p == 0 || 0 != p)
+        x = 1;
+    if (p == 1)
+        x = 2;
+    return 0;
+}
@@ -0,0 +1,11 @@
+// An assignment used as a condition is warned only if it is not
+// enclosed in extra parentheses.
+
+int main() {
+    int x;
+    if (x = 5)
+        x = 1;
+    if ((x = 5))
+        x = 1;
+    return 0;
+}
@@ -0,0 +1,15 @@
+// Assigning a pointer to a pointer of a different type is warned,
+// but a void pointer converts to and from any pointer.
+
+int main() {
+    int x;
+    int *ip = &x;
+    char *c = ip;
+    void *v = ip;
+    int *ip2 = v;
+    char *c2;
+    c2 = ip;
+    c2 = v;
+    int *ip3 = 0;
+    return 0;
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -12,10 +12,10 @@ import (
 var (
 	input_file string
 	buf        string
-	filename   string
 	keywords   *Map
 	ctx        *Context
 	symbols    = []Keyword{
+		{name: "...", ty: TK_ELLIPSIS},
 		{name: "<<=", ty: TK_SHL_EQ},
 		{name: ">>=", ty: TK_SHR_EQ},
 		{name: "!=", ty: TK_NE},
@@ -62,38 +62,34 @@ type Context struct {
 	pos    string
 	tokens *Vector
 	next   *Context
+
+	// Line number at pos and the beginning of that line
+	line       int
+	line_start string
 }
 
+// Reads a file, or stdin if path is "-". The contents always end
+// with a newline.
 func read_file(path string) string {
 	f := os.Stdin
 	if path != "-" {
 		f2, err := os.Open(path)
 		if err != nil {
-			log.Fatal(err)
+			error("cannot open %s: %v", path, err.(*os.PathError).Err)
 		}
 		f = f2
 		defer f2.Close()
 	}
-	defer f.Close()
-
-	sb := new_sb()
-	buf := make([]byte, 4096)
-	for {
-		n, err := f.Read(buf)
-		if n == 0 {
-			break
-		}
-		if err != nil {
-			break
-		}
-		sb_append_n(sb, string(buf[:n]), n)
 
+	b, err := io.ReadAll(f)
+	if err != nil {
+		error("cannot read %s: %v", path, err)
 	}
 
-	if sb.data[sb.len-1] != '\n' {
-		sb_add(sb, "\n")
+	if len(b) == 0 || b[len(b)-1] != '\n' {
+		b = append(b, '\n')
 	}
-	return sb_get(sb)
+	return string(b)
 }
 
 func new_ctx(next *Context, path, buf string) *Context {
@@ -101,6 +97,8 @@ func new_ctx(next *Context, path, buf string) *Context {
 	ctx.path = path
 	ctx.buf = buf
 	ctx.pos = ctx.buf
+	ctx.line = 1
+	ctx.line_start = ctx.buf
 	ctx.tokens = new_vec()
 	ctx.next = next
 	return ctx
@@ -108,48 +106,56 @@ func new_ctx(next *Context, path, buf string) *Context {
 
 // Error reporting
 
-// Finds a line pointed by a given pointer from the input line
-// to print it out.
-func print_line(buf, path, pos string) {
-	curline, s := buf, buf
-	line, col := 0, 0
-
-	for i, c := range buf {
-
-		if c == '\n' {
-			curline = buf[i+1:]
-			line++
-			col = 0
-			s = buf[i+1:]
-			continue
+// Moves ctx.pos forward to p, counting newlines on the way.
+// Positions are visited in increasing order while scanning, so
+// the whole input is read only once.
+func advance(p string) {
+	for len(ctx.pos) > len(p) {
+		if ctx.pos[0] == '\n' {
+			ctx.line++
+			ctx.line_start = ctx.pos[1:]
 		}
+		ctx.pos = ctx.pos[1:]
+	}
+}
 
-		if s != pos {
-			col++
-			s = buf[i+1:]
-			continue
-		}
+// Prints a message in the form of "path:line:col: kind: msg"
+// followed by the source line and a caret under the column.
+func report(path string, line, col int, curline, kind, msg string) {
+	fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", path, line, col, kind, msg)
+	if i := strings.IndexByte(curline, '\n'); i >= 0 {
+		curline = curline[:i]
+	}
+	fmt.Fprintf(os.Stderr, "%s\n%s^\n", curline, strings.Repeat(" ", col-1))
+}
 
-		fmt.Fprintf(os.Stderr, "error at %s:%d:%d\n\n", path, line+1, col+1)
-		for i, c2 := range curline {
-			if c2 == '\n' {
-				curline = curline[:i]
-				break
-			}
-		}
-		fmt.Fprintf(os.Stderr, "%s\n", curline)
+// Reports an error at a position in the input being scanned.
+func error_at(p, msg string) {
+	advance(p)
+	report(ctx.path, ctx.line, len(ctx.line_start)-len(p)+1, ctx.line_start, "error", msg)
+	os.Exit(EXIT_ERROR)
+}
 
-		for i := 0; i < col-1; i++ {
-			fmt.Fprintf(os.Stderr, " ")
-		}
-		fmt.Fprintf(os.Stderr, "^\n\n")
-		return
-	}
+// Returns the source line containing a given token.
+func line_of(t *Token) string {
+	return t.buf[len(t.buf)-len(t.start)-(t.col-1):]
 }
 
 func bad_token(t *Token, msg string) {
-	print_line(t.buf, t.path, t.start)
-	error(msg)
+	// Tokens made by the preprocessor have no position.
+	if t.line == 0 {
+		error("%s", msg)
+	}
+	report(t.path, t.line, t.col, line_of(t), "error", msg)
+	os.Exit(EXIT_ERROR)
+}
+
+func warn_token(t *Token, msg string) {
+	if t.line == 0 {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+		return
+	}
+	report(t.path, t.line, t.col, line_of(t), "warning", msg)
 }
 
 func tokstr(t *Token) string {
@@ -157,16 +163,6 @@ func tokstr(t *Token) string {
 	return strndup(t.start, len(t.start)-len(t.end))
 }
 
-func line(t *Token) int {
-	n := 1
-	for i := 0; i < len(t.buf)-len(t.end); i++ {
-		if rune(t.buf[i]) == '\n' {
-			n++
-		}
-	}
-	return n
-}
-
 // Atomic unit in the grammer is called "token".
 // For example, `123`, `"abc"` and `while` are tokens.
 // The tokenizer splits an inpuit string into tokens.
@@ -178,6 +174,9 @@ func add_t(ty int, start string) *Token {
 	t.start = start
 	t.path = ctx.path
 	t.buf = ctx.buf
+	advance(start)
+	t.line = ctx.line
+	t.col = len(ctx.line_start) - len(start) + 1
 	vec_push(ctx.tokens, t)
 	return t
 }
@@ -185,19 +184,32 @@ func add_t(ty int, start string) *Token {
 func keyword_map() *Map {
 	kmap := new_map()
 	map_puti(kmap, "_Alignof", TK_ALIGNOF)
+	map_puti(kmap, "_Static_assert", TK_ASSERT)
 	map_puti(kmap, "break", TK_BREAK)
+	map_puti(kmap, "case", TK_CASE)
 	map_puti(kmap, "char", TK_CHAR)
+	map_puti(kmap, "continue", TK_CONTINUE)
+	map_puti(kmap, "default", TK_DEFAULT)
 	map_puti(kmap, "do", TK_DO)
 	map_puti(kmap, "else", TK_ELSE)
+	map_puti(kmap, "enum", TK_ENUM)
 	map_puti(kmap, "extern", TK_EXTERN)
 	map_puti(kmap, "for", TK_FOR)
+	map_puti(kmap, "goto", TK_GOTO)
 	map_puti(kmap, "if", TK_IF)
 	map_puti(kmap, "int", TK_INT)
+	map_puti(kmap, "long", TK_LONG)
+	map_puti(kmap, "unsigned", TK_UNSIGNED)
 	map_puti(kmap, "return", TK_RETURN)
+	map_puti(kmap, "short", TK_SHORT)
+	map_puti(kmap, "signed", TK_SIGNED)
 	map_puti(kmap, "sizeof", TK_SIZEOF)
 	map_puti(kmap, "struct", TK_STRUCT)
+	map_puti(kmap, "union", TK_UNION)
+	map_puti(kmap, "switch", TK_SWITCH)
 	map_puti(kmap, "typedef", TK_TYPEDEF)
 	map_puti(kmap, "void", TK_VOID)
+	map_puti(kmap, "volatile", TK_VOLATILE)
 	map_puti(kmap, "while", TK_WHILE)
 	return kmap
 }
@@ -208,11 +220,29 @@ func block_comment(pos string) string {
 			return s[2:]
 		}
 	}
-	print_line(buf, filename, pos)
-	error("unclosed comment")
+	error_at(pos, "unclosed comment")
 	return ""
 }
 
+// Reads an escape sequence after a backslash and returns its value
+// and the rest of the input. An octal escape such as `\0` or `\101`
+// has up to three digits.
+func read_escape(p string) (int, string) {
+	if '0' <= p[0] && p[0] <= '7' {
+		c := 0
+		for i := 0; i < 3 && len(p) != 0 && '0' <= p[0] && p[0] <= '7'; i++ {
+			c = c*8 + int(p[0]) - '0'
+			p = p[1:]
+		}
+		return c, p
+	}
+
+	if esc := escaped[rune(p[0])]; esc != 0 {
+		return esc, p[1:]
+	}
+	return int(p[0]), p[1:]
+}
+
 func char_literal(p string) string {
 	t := add_t(TK_NUM, p)
 	p = p[1:]
@@ -220,6 +250,9 @@ func char_literal(p string) string {
 	if len(p) == 0 {
 		goto err
 	}
+	if p[0] == '\'' {
+		bad_token(t, "empty character literal")
+	}
 
 	if rune(p[0]) != '\\' {
 		t.val = int(p[0])
@@ -228,16 +261,10 @@ func char_literal(p string) string {
 		if len(p) < 2 {
 			goto err
 		}
-		esc := escaped[rune(p[1])]
-		if esc != 0 {
-			t.val = esc
-		} else {
-			t.val = int(p[1])
-		}
-		p = p[2:]
+		t.val, p = read_escape(p[1:])
 	}
 
-	if p[0] != '\'' {
+	if len(p) == 0 || p[0] != '\'' {
 		goto err
 	}
 	t.end = p[1:]
@@ -254,10 +281,13 @@ func string_literal(p string) string {
 	p = p[1:]
 	sb := new_sb()
 
-	for rune(p[0]) != '"' {
+	for {
 		if len(p) == 0 {
 			goto err
 		}
+		if p[0] == '"' {
+			break
+		}
 
 		if p[0] != '\\' {
 			sb_add(sb, string(p[0]))
@@ -269,13 +299,13 @@ func string_literal(p string) string {
 		if len(p) == 0 {
 			goto err
 		}
-		esc := escaped[rune(p[0])]
-		if esc != 0 {
-			sb_add(sb, string(esc))
-		} else {
-			sb_add(sb, string(p[0]))
+		if p[0] == '\n' {
+			p = p[1:]
+			continue
 		}
-		p = p[1:]
+		var c int
+		c, p = read_escape(p)
+		sb_add(sb, string([]byte{byte(c)}))
 	}
 
 	t.str = sb_get(sb)
@@ -288,56 +318,72 @@ err:
 	return ""
 }
 
+// Skips backslash-newlines at the beginning of p. They may appear
+// anywhere, even in the middle of an identifier or a number.
+func splice(p string) string {
+	for strncmp(p, "\\\n", 2) == 0 {
+		p = p[2:]
+	}
+	return p
+}
+
 func ident_t(p string) string {
-	len := 1
-	for isalpha(rune(p[len])) || unicode.IsDigit(rune(p[len])) || p[len] == '_' {
-		len++
+	t := add_t(TK_IDENT, p)
+	sb := new_sb()
+	sb_add(sb, string(p[0]))
+	p = p[1:]
+
+	for {
+		q := splice(p)
+		if len(q) == 0 || !(isalpha(rune(q[0])) || unicode.IsDigit(rune(q[0])) || q[0] == '_') {
+			break
+		}
+		sb_add(sb, string(q[0]))
+		p = q[1:]
 	}
 
-	name := strndup(p, len)
-	ty := map_geti(keywords, name, TK_IDENT)
-	t := add_t(ty, p)
-	t.name = name
-	t.end = p[len:]
-	return p[len:]
+	t.name = sb_get(sb)
+	t.ty = map_geti(keywords, t.name, TK_IDENT)
+	t.end = p
+	return p
 }
 
 func hexadecimal(p string) string {
 	t := add_t(TK_NUM, p)
 	p = p[2:]
 
-	if !isxdigit(string(p[0])) {
+	if q := splice(p); len(q) == 0 || !isxdigit(string(q[0])) {
 		bad_token(t, "bad hexadecimal number")
 	}
 
 	for {
-		c := int(p[0])
+		q := splice(p)
+		if len(q) == 0 {
+			break
+		}
+		c := int(q[0])
 		if '0' <= c && c <= '9' {
 			t.val = t.val*16 + c - '0'
-			p = p[1:]
 		} else if 'a' <= c && c <= 'f' {
 			t.val = t.val*16 + c - 'a' + 10
-			p = p[1:]
 		} else if 'A' <= c && c <= 'F' {
 			t.val = t.val*16 + c - 'A' + 10
-			p = p[1:]
 		} else {
-			t.end = p
-			return p
+			break
 		}
+		p = q[1:]
 	}
-	return ""
+	t.end = p
+	return p
 }
 
 func octal(p string) string {
 	t := add_t(TK_NUM, p)
 	p = p[1:]
 
-	c := p[0]
-	for '0' <= c && c <= '7' {
-		t.val = t.val*8 + int(c) - '0'
-		p = p[1:]
-		c = p[0]
+	for q := splice(p); len(q) != 0 && '0' <= q[0] && q[0] <= '7'; q = splice(p) {
+		t.val = t.val*8 + int(q[0]) - '0'
+		p = q[1:]
 	}
 	t.end = p
 	return p
@@ -345,22 +391,30 @@ func octal(p string) string {
 
 func decimal(p string) string {
 	t := add_t(TK_NUM, p)
-	for unicode.IsDigit(rune(p[0])) {
-		t.val = t.val*10 + int(p[0]) - '0'
-		p = p[1:]
+	for q := splice(p); len(q) != 0 && unicode.IsDigit(rune(q[0])); q = splice(p) {
+		t.val = t.val*10 + int(q[0]) - '0'
+		p = q[1:]
 	}
 	t.end = p
 	return p
 }
 
 func number(p string) string {
+	var q string
 	if strncasecmp(p, "0x", 2) == 0 {
-		return hexadecimal(p)
+		q = hexadecimal(p)
+	} else if p[0] == '0' {
+		q = octal(p)
+	} else {
+		q = decimal(p)
 	}
-	if p[0] == '0' {
-		return octal(p)
+
+	// A number must not be immediately followed by a letter or
+	// a digit, such as `09` or `12ab`.
+	if r := splice(q); len(r) != 0 && (isalpha(rune(r[0])) || r[0] == '_' || unicode.IsDigit(rune(r[0]))) {
+		bad_token(vec_last(ctx.tokens).(*Token), "invalid number")
 	}
-	return decimal(p)
+	return q
 }
 
 // Tokenized input is stored to this array
@@ -378,6 +432,14 @@ loop:
 			continue
 		}
 
+		// Line continuation. A backslash-newline is spliced out here
+		// rather than before scanning so that the newline still counts
+		// toward line numbers in diagnostics.
+		if strncmp(p, "\\\n", 2) == 0 {
+			p = p[2:]
+			continue
+		}
+
 		// Whitespace
 		if unicode.IsSpace(c) {
 			p = p[1:]
@@ -386,9 +448,11 @@ loop:
 
 		// Line comment
 		if strncmp(p, "//", 2) == 0 {
-			for len(p) != 0 && c != '\n' {
+			for len(p) != 0 && p[0] != '\n' {
+				if strncmp(p, "\\\n", 2) == 0 {
+					p = p[1:]
+				}
 				p = p[1:]
-				c = rune(p[0])
 			}
 			continue
 		}
@@ -411,12 +475,11 @@ loop:
 			continue
 		}
 
-		// Multi-letter symbol
+		// Multi-letter symbol. A symbol longer than the rest of
+		// the input does not match, so `<` at the end of a file is
+		// read as a single-letter symbol.
 		for _, sym := range symbols {
 			length := len(sym.name)
-			if length > len(p) {
-				length = len(p)
-			}
 			if strncmp(p, sym.name, length) != 0 {
 				continue
 			}
@@ -446,8 +509,7 @@ loop:
 			continue
 		}
 
-		print_line(ctx.buf, ctx.path, p)
-		error("cannot tokenize")
+		error_at(p, "cannot tokenize")
 	}
 }
 
@@ -455,10 +517,6 @@ func canonicalize_newline(p string) string {
 	return strings.Replace(p, "\r\n", "\n", -1)
 }
 
-func remove_backslash_newline(p string) string {
-	return strings.Replace(p, "\\\n", "", -1)
-}
-
 func strip_newline_tokens(tokens *Vector) *Vector {
 	v := new_vec()
 	for i := 0; i < tokens.len; i++ {
@@ -496,13 +554,16 @@ func join_string_literals(tokens *Vector) *Vector {
 }
 
 func tokenize(path string, add_eof bool) *Vector {
+	return tokenize_buf(path, read_file(path), add_eof)
+}
+
+// Tokenizes source code in a string. path is used in diagnostics.
+func tokenize_buf(path, src string, add_eof bool) *Vector {
 	if keywords == nil {
 		keywords = keyword_map()
 	}
 
-	buf = read_file(path)
-	buf = canonicalize_newline(buf)
-	buf = remove_backslash_newline(buf)
+	buf = canonicalize_newline(src)
 
 	ctx = new_ctx(ctx, path, buf)
 	scan()
@@ -525,18 +586,31 @@ func print_tokens(tokens *Vector) {
 		TK_STR:       "TK_STR      ",
 		TK_IDENT:     "TK_IDENT    ",
 		TK_ARROW:     "TK_ARROW    ",
+		TK_ELLIPSIS:  "TK_ELLIPSIS ",
 		TK_EXTERN:    "TK_EXTERN   ",
 		TK_TYPEDEF:   "TK_TYPEDEF  ",
+		TK_VOLATILE:  "TK_VOLATILE ",
 		TK_INT:       "TK_INT      ",
 		TK_CHAR:      "TK_CHAR     ",
+		TK_SHORT:     "TK_SHORT    ",
+		TK_LONG:      "TK_LONG     ",
+		TK_UNSIGNED:  "TK_UNSIGNED ",
+		TK_SIGNED:    "TK_SIGNED   ",
 		TK_VOID:      "TK_VOID     ",
 		TK_STRUCT:    "TK_STRUCT   ",
+		TK_UNION:     "TK_UNION    ",
+		TK_ENUM:      "TK_ENUM     ",
 		TK_IF:        "TK_IF       ",
 		TK_ELSE:      "TK_ELSE     ",
 		TK_FOR:       "TK_FOR      ",
 		TK_DO:        "TK_DO       ",
 		TK_WHILE:     "TK_WHILE    ",
 		TK_BREAK:     "TK_BREAK    ",
+		TK_CONTINUE:  "TK_CONTINUE ",
+		TK_GOTO:      "TK_GOTO     ",
+		TK_SWITCH:    "TK_SWITCH   ",
+		TK_CASE:      "TK_CASE     ",
+		TK_DEFAULT:   "TK_DEFAULT  ",
 		TK_EQ:        "TK_EQ       ",
 		TK_NE:        "TK_NE       ",
 		TK_LE:        "TK_LE       ",
@@ -560,6 +634,7 @@ func print_tokens(tokens *Vector) {
 		TK_RETURN:    "TK_RETURN   ",
 		TK_SIZEOF:    "TK_SIZEOF   ",
 		TK_ALIGNOF:   "TK_ALIGNOF  ",
+		TK_ASSERT:    "TK_ASSERT   ",
 		TK_PARAM:     "TK_PARAM    ",
 		TK_EOF:       "TK_EOF      ",
 	}
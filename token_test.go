@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_scan_eof(t *testing.T) {
+	cases := []struct {
+		src  string
+		want []int
+	}{
+		{"1 <", []int{TK_NUM, '<', TK_EOF}},
+		{"1 >", []int{TK_NUM, '>', TK_EOF}},
+		{"1 &", []int{TK_NUM, '&', TK_EOF}},
+		{"1 |", []int{TK_NUM, '|', TK_EOF}},
+		{"1 -", []int{TK_NUM, '-', TK_EOF}},
+		{"1 .", []int{TK_NUM, '.', TK_EOF}},
+		{"1 <<", []int{TK_NUM, TK_SHL, TK_EOF}},
+		{"1 >>", []int{TK_NUM, TK_SHR, TK_EOF}},
+		{"1 >>=", []int{TK_NUM, TK_SHR_EQ, TK_EOF}},
+		{"1 // comment", []int{TK_NUM, TK_EOF}},
+	}
+
+	for _, c := range cases {
+		v := tokenize_buf("test", c.src, true)
+		if v.len != len(c.want) {
+			t.Errorf("%q: %d tokens, want %d", c.src, v.len, len(c.want))
+			continue
+		}
+		for i, ty := range c.want {
+			if got := v.data[i].(*Token).ty; got != ty {
+				t.Errorf("%q: token %d is %d, want %d", c.src, i, got, ty)
+			}
+		}
+	}
+}
+
+func Test_number(t *testing.T) {
+	cases := []struct {
+		src string
+		val int
+	}{
+		{"0", 0},
+		{"10", 10},
+		{"0755", 493},
+		{"0x1F", 31},
+		{"0XbeEF", 48879},
+	}
+
+	for _, c := range cases {
+		v := tokenize_buf("test", c.src, true)
+		tok := v.data[0].(*Token)
+		if tok.ty != TK_NUM || tok.val != c.val {
+			t.Errorf("%q: got %d, want %d", c.src, tok.val, c.val)
+		}
+		if s := tokstr(tok); s != c.src {
+			t.Errorf("%q: token text is %q", c.src, s)
+		}
+	}
+}
+
+func Test_comment(t *testing.T) {
+	cases := []struct {
+		src  string
+		want []int
+	}{
+		{"1 // 2\n3", []int{TK_NUM, TK_NUM, TK_EOF}},
+		{"1 /* 2\n3 */ 4", []int{TK_NUM, TK_NUM, TK_EOF}},
+		{"1 /**/ / 2", []int{TK_NUM, '/', TK_NUM, TK_EOF}},
+		{"a/b", []int{TK_IDENT, '/', TK_IDENT, TK_EOF}},
+		{"a /= b", []int{TK_IDENT, TK_DIV_EQ, TK_IDENT, TK_EOF}},
+		{"a!=!b", []int{TK_IDENT, TK_NE, '!', TK_IDENT, TK_EOF}},
+	}
+
+	for _, c := range cases {
+		v := tokenize_buf("test", c.src, true)
+		if v.len != len(c.want) {
+			t.Errorf("%q: %d tokens, want %d", c.src, v.len, len(c.want))
+			continue
+		}
+		for i, ty := range c.want {
+			if got := v.data[i].(*Token).ty; got != ty {
+				t.Errorf("%q: token %d is %d, want %d", c.src, i, got, ty)
+			}
+		}
+	}
+}
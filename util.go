@@ -70,33 +70,19 @@ func ary_of(base *Type, length int) *Type {
 	return ty
 }
 
-func size_of(ty *Type) int {
-	if ty.ty == CHAR {
-		return 1
-	}
-	if ty.ty == INT {
-		return 4
-	}
-	if ty.ty == PTR {
-		return 8
-	}
-	// assert(ty.ty == ARY)
-	return size_of(ty.ary_of) * ty.len
+func func_of(returning *Type) *Type {
+	ty := new(Type)
+	ty.ty = FUNC
+	ty.returning = returning
+	return ty
 }
 
-func align_of(ty *Type) int {
-	if ty.ty == CHAR {
-		return 1
-	}
-	if ty.ty == INT {
-		return 4
-	}
-	if ty.ty == PTR {
-		return 8
-	}
-	// assert(ty.ty == ARY)
-	return align_of(ty.ary_of)
-}
+// Sizes and alignments are computed once when a type is constructed
+// (see ptr_to, ary_of and add_members), so these are just lookups.
+// Don't walk derived types here; that would recompute the size of
+// every element type on each pointer arithmetic.
+func size_of(ty *Type) int  { return ty.size }
+func align_of(ty *Type) int { return ty.align }
 
 func copy_node(src, dst *Node) {
 	if src == nil {
@@ -221,11 +207,36 @@ func vec_push(v *Vector, elem interface{}) {
 	v.len++
 }
 
+func vec_pop(v *Vector) interface{} {
+	// assert(v.len)
+	v.len--
+	return v.data[v.len]
+}
+
+func vec_last(v *Vector) interface{} {
+	// assert(v.len)
+	return v.data[v.len-1]
+}
+
+// Exit status, so that scripts can tell a bad command line from
+// a program that does not compile.
+const (
+	EXIT_ERROR = 1 // compile error
+	EXIT_USAGE = 2 // bad command line
+)
+
 // An error reporting function
 func error(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	fmt.Fprintf(os.Stderr, "\n")
-	os.Exit(1)
+	os.Exit(EXIT_ERROR)
+}
+
+func bool2int(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func popcount(x uint) int {
@@ -137,3 +137,38 @@ func Test_ctz(t *testing.T) {
 		}
 	}
 }
+
+func Test_size_of(t *testing.T) {
+	members := new_vec()
+	for _, ty := range []*Type{char_tyf(), int_tyf()} {
+		m := new(Node)
+		m.ty = ty
+		vec_push(members, m)
+	}
+	st := new(Type)
+	st.ty = STRUCT
+	add_members(st, members, false)
+
+	ty := ptr_to(ary_of(ary_of(st, 3), 2))
+
+	// Clobbering the struct must not affect derived types,
+	// whose sizes were fixed at construction.
+	st.size = 0
+	st.members = nil
+
+	cases := []struct {
+		ty    *Type
+		size  int
+		align int
+	}{
+		{ty, 8, 8},
+		{ty.ptr_to, 48, 4},
+		{ty.ptr_to.ary_of, 24, 4},
+	}
+
+	for _, c := range cases {
+		if size_of(c.ty) != c.size || align_of(c.ty) != c.align {
+			t.Errorf("expected: (%d, %d), got: (%d, %d)\n", c.size, c.align, size_of(c.ty), align_of(c.ty))
+		}
+	}
+}